@@ -0,0 +1,222 @@
+//! A server speaking a subset of the Redis protocol (RESP), so existing Redis clients can use
+//! boulder as a durable store for simple workloads.
+//!
+//! ```text
+//! cargo run --example resp_server -- /tmp/boulder 127.0.0.1:6379
+//! redis-cli SET greeting hello EX 60
+//! ```
+//!
+//! Supported commands are PING, GET, SET (with EX or PX), DEL, EXISTS and EXPIRE. SCAN is
+//! not supported yet because the database has no public iterator.
+
+use std::io::{self, BufRead, BufReader, BufWriter, Read, Write};
+use std::net::{TcpListener, TcpStream};
+use std::sync::Arc;
+use std::time::Duration;
+
+use anyhow::{bail, Result};
+use boulder::DB;
+use bytes::Bytes;
+
+/// The most arguments a command may have, as in Redis.
+const MAX_ARGS: usize = 1024 * 1024;
+
+/// The longest bulk string a client may send, like Redis's `proto-max-bulk-len`.
+const MAX_BULK_LEN: usize = 512 * 1024 * 1024;
+
+/// The longest header line a client may send.
+const MAX_LINE_LEN: usize = 64 * 1024;
+
+fn main() -> Result<()> {
+    let mut args = std::env::args().skip(1);
+    let path = args.next().unwrap_or_else(|| "boulder-data".into());
+    let addr = args.next().unwrap_or_else(|| "127.0.0.1:6379".into());
+
+    let db = Arc::new(DB::open(&path)?);
+    let listener = TcpListener::bind(&addr)?;
+    println!("serving {path} on {addr}");
+
+    for stream in listener.incoming() {
+        let stream = stream?;
+        let db = db.clone();
+        std::thread::spawn(move || {
+            if let Err(e) = serve(&db, stream) {
+                eprintln!("connection closed: {e:#}");
+            }
+        });
+    }
+    Ok(())
+}
+
+/// A reply to a command.
+enum Reply {
+    Simple(&'static str),
+    Error(String),
+    Integer(i64),
+    Bulk(Option<Bytes>),
+}
+
+impl Reply {
+    fn write_to<W: Write>(&self, out: &mut W) -> io::Result<()> {
+        match self {
+            Reply::Simple(s) => write!(out, "+{s}\r\n"),
+            Reply::Error(e) => write!(out, "-{e}\r\n"),
+            Reply::Integer(n) => write!(out, ":{n}\r\n"),
+            Reply::Bulk(None) => write!(out, "$-1\r\n"),
+            Reply::Bulk(Some(value)) => {
+                write!(out, "${}\r\n", value.len())?;
+                out.write_all(value)?;
+                out.write_all(b"\r\n")
+            }
+        }
+    }
+}
+
+fn serve(db: &DB, stream: TcpStream) -> Result<()> {
+    let mut reader = BufReader::new(stream.try_clone()?);
+    let mut writer = BufWriter::new(stream);
+    while let Some(args) = read_command(&mut reader)? {
+        let reply = execute(db, &args).unwrap_or_else(|e| Reply::Error(format!("ERR {e:#}")));
+        reply.write_to(&mut writer)?;
+        // Clients may pipeline commands, so only flush once the ones already sent are answered.
+        if reader.buffer().is_empty() {
+            writer.flush()?;
+        }
+    }
+    Ok(())
+}
+
+/// Reads a command sent as an array of bulk strings, returning `None` when the client hangs up.
+fn read_command<R: BufRead>(reader: &mut R) -> Result<Option<Vec<Bytes>>> {
+    let Some(header) = read_line(reader)? else {
+        return Ok(None);
+    };
+    let Some(count) = header.strip_prefix('*') else {
+        bail!("expected an array, got {header:?}");
+    };
+
+    let count: usize = count.parse()?;
+    if count > MAX_ARGS {
+        bail!("too many arguments: {count}");
+    }
+    // The count and lengths are only claims until the data arrives, so grow the buffers as it
+    // does rather than allocating up front.
+    let mut args = Vec::new();
+    for _ in 0..count {
+        let Some(header) = read_line(reader)? else {
+            bail!("connection closed mid-command");
+        };
+        let Some(len) = header.strip_prefix('$') else {
+            bail!("expected a bulk string, got {header:?}");
+        };
+        let len: usize = len.parse()?;
+        if len > MAX_BULK_LEN {
+            bail!("bulk string of {len} bytes is too long");
+        }
+        let mut arg = Vec::new();
+        reader.by_ref().take(len as u64).read_to_end(&mut arg)?;
+        let mut crlf = [0u8; 2];
+        if arg.len() != len || reader.read_exact(&mut crlf).is_err() {
+            bail!("connection closed mid-command");
+        }
+        if &crlf != b"\r\n" {
+            bail!("bulk string is not terminated by CRLF");
+        }
+        args.push(Bytes::from(arg));
+    }
+    Ok(Some(args))
+}
+
+fn read_line<R: BufRead>(reader: &mut R) -> Result<Option<String>> {
+    let mut line = String::new();
+    if reader.by_ref().take(MAX_LINE_LEN as u64 + 1).read_line(&mut line)? == 0 {
+        return Ok(None);
+    }
+    if !line.ends_with('\n') && line.len() > MAX_LINE_LEN {
+        bail!("line is too long");
+    }
+    Ok(Some(line.trim_end_matches(['\r', '\n']).to_string()))
+}
+
+fn execute(db: &DB, args: &[Bytes]) -> Result<Reply> {
+    let Some((command, args)) = args.split_first() else {
+        bail!("empty command");
+    };
+    let command = String::from_utf8_lossy(command).to_ascii_uppercase();
+    let arity = |n: usize| -> Result<()> {
+        if args.len() < n {
+            bail!("wrong number of arguments for '{}'", command.to_lowercase());
+        }
+        Ok(())
+    };
+
+    match command.as_str() {
+        "PING" => Ok(Reply::Simple("PONG")),
+        "GET" => {
+            arity(1)?;
+            Ok(Reply::Bulk(db.get(&args[0])?))
+        }
+        "SET" => {
+            arity(2)?;
+            match &args[2..] {
+                [] => db.insert(args[0].clone(), args[1].clone())?,
+                [unit, amount] => {
+                    let amount: u64 = parse(amount)?;
+                    let ttl = match String::from_utf8_lossy(unit).to_ascii_uppercase().as_str() {
+                        "EX" => Duration::from_secs(amount),
+                        "PX" => Duration::from_millis(amount),
+                        _ => bail!("syntax error"),
+                    };
+                    if ttl.is_zero() {
+                        bail!("invalid expire time in 'set' command");
+                    }
+                    db.insert_with_ttl(args[0].clone(), args[1].clone(), ttl)?;
+                }
+                _ => bail!("syntax error"),
+            }
+            Ok(Reply::Simple("OK"))
+        }
+        "DEL" => {
+            arity(1)?;
+            let mut deleted = 0;
+            for key in args {
+                if db.get(key)?.is_some() {
+                    db.remove(key.clone())?;
+                    deleted += 1;
+                }
+            }
+            Ok(Reply::Integer(deleted))
+        }
+        "EXISTS" => {
+            arity(1)?;
+            let mut found = 0;
+            for key in args {
+                if db.get(key)?.is_some() {
+                    found += 1;
+                }
+            }
+            Ok(Reply::Integer(found))
+        }
+        "EXPIRE" => {
+            // Rewrites the current value with a TTL. Not atomic: a write landing between the read
+            // and the rewrite is overwritten.
+            arity(2)?;
+            let ttl = Duration::from_secs(parse(&args[1])?);
+            match db.get(&args[0])? {
+                Some(value) => {
+                    db.insert_with_ttl(args[0].clone(), value, ttl)?;
+                    Ok(Reply::Integer(1))
+                }
+                None => Ok(Reply::Integer(0)),
+            }
+        }
+        _ => bail!("unknown command '{}'", command.to_lowercase()),
+    }
+}
+
+fn parse<T: std::str::FromStr>(arg: &[u8]) -> Result<T> {
+    std::str::from_utf8(arg)
+        .ok()
+        .and_then(|s| s.parse().ok())
+        .ok_or_else(|| anyhow::anyhow!("value is not an integer or out of range"))
+}
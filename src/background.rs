@@ -0,0 +1,132 @@
+use std::any::Any;
+use std::backtrace::Backtrace;
+use std::cell::{Cell, RefCell};
+use std::panic::{self, AssertUnwindSafe};
+use std::sync::{Arc, Once};
+use std::thread::JoinHandle;
+
+use anyhow::{anyhow, Result};
+
+use crate::logger::Logger;
+
+thread_local! {
+    /// Set on background threads, whose panics have their stack captured.
+    static CAPTURE_BACKTRACE: Cell<bool> = const { Cell::new(false) };
+    /// The stack of the last panic on this thread, captured by the hook installed by [`spawn`].
+    static PANIC_BACKTRACE: RefCell<Option<Backtrace>> = const { RefCell::new(None) };
+}
+
+/// Spawns a named background thread running `f`. An error returned by `f` is passed to
+/// `on_error`, and so is a panic, so that a bug in background work puts the database into its
+/// background-error state rather than silently killing the thread. With `abort_on_panic` set, a
+/// panic aborts the process instead, for operators who prefer to crash and restart. Either way the
+/// panic is reported to `logger` along with the stack it was raised from.
+pub fn spawn<F, E>(
+    name: &str,
+    abort_on_panic: bool,
+    logger: Arc<dyn Logger>,
+    f: F,
+    on_error: E,
+) -> Result<JoinHandle<()>>
+where
+    F: FnOnce() -> Result<()> + Send + 'static,
+    E: Fn(anyhow::Error) + Send + 'static,
+{
+    install_panic_hook();
+    let thread_name = name.to_string();
+    let handle = std::thread::Builder::new().name(name.into()).spawn(move || {
+        CAPTURE_BACKTRACE.set(true);
+        match panic::catch_unwind(AssertUnwindSafe(f)) {
+            Ok(Ok(())) => {}
+            Ok(Err(e)) => on_error(e),
+            Err(payload) => {
+                let message = panic_message(payload.as_ref());
+                let backtrace = PANIC_BACKTRACE
+                    .take()
+                    .map_or_else(|| "backtrace unavailable".to_string(), |b| b.to_string());
+                logger.error(format_args!("{thread_name} panicked: {message}\n{backtrace}"));
+                if abort_on_panic {
+                    std::process::abort();
+                }
+                on_error(anyhow!("{thread_name} panicked: {message}"));
+            }
+        }
+    })?;
+    Ok(handle)
+}
+
+/// Chains a panic hook in front of the current one that captures the stack of panics on
+/// background threads, since it has already unwound by the time `catch_unwind` returns. A hook
+/// installed by the application afterwards replaces it, and panics are then reported without
+/// their stack.
+fn install_panic_hook() {
+    static INSTALL: Once = Once::new();
+    INSTALL.call_once(|| {
+        let previous = panic::take_hook();
+        panic::set_hook(Box::new(move |info| {
+            if CAPTURE_BACKTRACE.get() {
+                PANIC_BACKTRACE.set(Some(Backtrace::force_capture()));
+            }
+            previous(info);
+        }));
+    });
+}
+
+fn panic_message(payload: &(dyn Any + Send)) -> &str {
+    if let Some(message) = payload.downcast_ref::<&str>() {
+        message
+    } else if let Some(message) = payload.downcast_ref::<String>() {
+        message
+    } else {
+        "unknown panic"
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fmt;
+    use std::sync::mpsc;
+
+    use parking_lot::Mutex;
+
+    use super::*;
+
+    #[derive(Default)]
+    struct CapturingLogger {
+        errors: Mutex<Vec<String>>,
+    }
+
+    impl Logger for CapturingLogger {
+        fn info(&self, _args: fmt::Arguments<'_>) {}
+
+        fn error(&self, args: fmt::Arguments<'_>) {
+            self.errors.lock().push(args.to_string());
+        }
+    }
+
+    #[inline(never)]
+    fn failing_background_work() -> Result<()> {
+        panic!("boom");
+    }
+
+    #[test]
+    fn panic_is_logged_with_backtrace() {
+        let logger = Arc::new(CapturingLogger::default());
+        let (tx, rx) = mpsc::channel();
+        let handle = spawn(
+            "boulder-test",
+            false,
+            logger.clone(),
+            failing_background_work,
+            move |e| tx.send(e.to_string()).unwrap(),
+        )
+        .unwrap();
+        handle.join().unwrap();
+
+        assert_eq!(rx.recv().unwrap(), "boulder-test panicked: boom");
+        let errors = logger.errors.lock();
+        assert_eq!(errors.len(), 1);
+        assert!(errors[0].starts_with("boulder-test panicked: boom\n"));
+        assert!(errors[0].contains("failing_background_work"), "{}", errors[0]);
+    }
+}
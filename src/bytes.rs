@@ -0,0 +1,38 @@
+/// The most bytes a varint-encoded u64 can take.
+pub const MAX_VARINT_LEN: usize = 10;
+
+/// Appends `value` as an unsigned LEB128 varint.
+pub fn put_uvarint(buf: &mut Vec<u8>, mut value: u64) {
+    while value >= 0x80 {
+        buf.push(value as u8 | 0x80);
+        value >>= 7;
+    }
+    buf.push(value as u8);
+}
+
+/// Decodes an unsigned varint from the front of `buf`, returning the value and the number of bytes
+/// it took, or `None` if `buf` does not start with a complete varint that fits in a u64.
+pub fn get_uvarint(buf: &[u8]) -> Option<(u64, usize)> {
+    let mut value = 0u64;
+    for (i, &byte) in buf.iter().enumerate().take(MAX_VARINT_LEN) {
+        if i == MAX_VARINT_LEN - 1 && byte > 1 {
+            return None;
+        }
+        value |= u64::from(byte & 0x7f) << (7 * i);
+        if byte < 0x80 {
+            return Some((value, i + 1));
+        }
+    }
+    None
+}
+
+/// Appends `value` as a zigzag-encoded varint, which keeps small negative values short.
+pub fn put_varint(buf: &mut Vec<u8>, value: i64) {
+    put_uvarint(buf, ((value << 1) ^ (value >> 63)) as u64);
+}
+
+/// Decodes a zigzag-encoded varint written by [`put_varint`].
+pub fn get_varint(buf: &[u8]) -> Option<(i64, usize)> {
+    let (value, len) = get_uvarint(buf)?;
+    Some(((value >> 1) as i64 ^ -((value & 1) as i64), len))
+}
@@ -0,0 +1,59 @@
+use std::fmt;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use parking_lot::Mutex;
+
+/// The source of wall-clock time used to expire keys written with a TTL. Tests can substitute a
+/// [`ManualClock`] to control exactly when keys expire.
+pub trait Clock: Send + Sync {
+    fn now(&self) -> SystemTime;
+}
+
+impl fmt::Debug for dyn Clock {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "Clock({:?})", self.now())
+    }
+}
+
+/// A [`Clock`] backed by the system's wall clock.
+pub struct SystemClock;
+
+impl Clock for SystemClock {
+    fn now(&self) -> SystemTime {
+        SystemTime::now()
+    }
+}
+
+/// A [`Clock`] that only moves when told to.
+pub struct ManualClock {
+    now: Mutex<SystemTime>,
+}
+
+impl ManualClock {
+    pub fn new(now: SystemTime) -> Self {
+        ManualClock {
+            now: Mutex::new(now),
+        }
+    }
+
+    pub fn set(&self, now: SystemTime) {
+        *self.now.lock() = now;
+    }
+
+    pub fn advance(&self, by: Duration) {
+        *self.now.lock() += by;
+    }
+}
+
+impl Clock for ManualClock {
+    fn now(&self) -> SystemTime {
+        *self.now.lock()
+    }
+}
+
+/// Converts a time to the milliseconds since the Unix epoch stored alongside expiring values,
+/// clamping times before the epoch to zero.
+pub fn to_unix_millis(time: SystemTime) -> u64 {
+    time.duration_since(UNIX_EPOCH)
+        .map_or(0, |since| since.as_millis().min(u64::MAX as u128) as u64)
+}
@@ -0,0 +1,345 @@
+use std::collections::{HashMap, VecDeque};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Arc;
+use std::time::Instant;
+
+use anyhow::{anyhow, Result};
+use parking_lot::{Condvar, Mutex};
+
+use crate::batch::{Batch, BatchType};
+use crate::key::KeyTimestamp;
+use crate::metrics::{Histogram, LatencyHistogram};
+use crate::options::WriteOptions;
+
+/// The number of encoded bytes past which a leader stops pulling queued batches into its group,
+/// so that a deep queue cannot make a single log write arbitrarily large.
+const MAX_GROUP_BYTES: usize = 1 << 20;
+
+/// The parts of the database the commit pipeline drives.
+pub trait CommitEnv {
+    /// Writes the encoded batches of a commit group to the log, one record each. `last_seq` is the
+    /// sequence number of the group's last entry. If `sync` is set they are made durable with a
+    /// single sync before returning.
+    fn write(&self, records: &[Vec<u8>], last_seq: KeyTimestamp, sync: bool) -> Result<()>;
+
+    /// Applies a logged batch to the memtable with its entries numbered from `seq`. Batches of a
+    /// group are applied concurrently.
+    fn apply(&self, batch: &Batch<{ BatchType::Write }>, seq: KeyTimestamp) -> Result<()>;
+}
+
+enum CommitState {
+    Queued,
+    /// The batch has been logged and should be applied by the writer that queued it.
+    Apply,
+    Applied(Result<()>),
+    Done(Result<()>),
+}
+
+struct CommitRequest {
+    batch: Batch<{ BatchType::Write }>,
+    sync: bool,
+    caller: Option<u64>,
+    /// Orders requests by when they were queued.
+    ticket: u64,
+    seq: AtomicU64,
+    state: Mutex<CommitState>,
+}
+
+impl CommitRequest {
+    fn count(&self) -> u64 {
+        self.batch.len() as u64
+    }
+}
+
+/// Commits write batches in groups. Concurrent writers queue their batches and the writer at the
+/// front of the queue becomes the leader for everything queued behind it: it assigns each batch a
+/// contiguous run of sequence numbers and writes the whole group to the log with one write, and
+/// one sync if any writer in the group asked for it. Every writer then applies its own batch to
+/// the memtable in parallel, and once the whole group is applied its sequence numbers are
+/// published as visible together.
+///
+/// A batch too large to fit in the leader's group is passed over rather than ending the group, so
+/// small writes queued behind a writer issuing huge batches are not held back a group at a time.
+/// A batch that is passed over moves up the queue as the groups ahead of it commit, and leads a
+/// group of its own once it reaches the front.
+///
+/// Writers that identify themselves with [`WriteOptions::caller`] are grouped fairly: each
+/// caller's first queued batch is taken before any caller's second, so that a caller with many
+/// batches queued at once cannot fill group after group ahead of the others.
+pub struct CommitPipeline {
+    queue: Mutex<VecDeque<Arc<CommitRequest>>>,
+    changed: Condvar,
+    next_ticket: AtomicU64,
+    /// The last sequence number assigned to a batch, whether or not it has been logged yet.
+    assigned_seq: AtomicU64,
+    /// The last sequence number written to the log. It may not be durable yet.
+    logged_seq: AtomicU64,
+    /// The last sequence number that readers may observe. Every batch at or below it has been
+    /// applied to the memtable.
+    visible_seq: AtomicU64,
+    commit_latency: Histogram,
+}
+
+impl CommitPipeline {
+    pub fn new(last_seq: KeyTimestamp) -> Self {
+        CommitPipeline {
+            queue: Mutex::new(VecDeque::new()),
+            changed: Condvar::new(),
+            next_ticket: AtomicU64::new(0),
+            assigned_seq: AtomicU64::new(last_seq),
+            logged_seq: AtomicU64::new(last_seq),
+            visible_seq: AtomicU64::new(last_seq),
+            commit_latency: Histogram::new(),
+        }
+    }
+
+    pub fn visible_seq(&self) -> KeyTimestamp {
+        self.visible_seq.load(Ordering::Acquire)
+    }
+
+    pub fn logged_seq(&self) -> KeyTimestamp {
+        self.logged_seq.load(Ordering::Acquire)
+    }
+
+    /// Returns how long each commit has taken, from queueing its batch to it becoming visible.
+    pub fn commit_latency(&self) -> LatencyHistogram {
+        self.commit_latency.snapshot()
+    }
+
+    /// Commits the batch and returns the sequence number of its first entry.
+    pub fn commit<E: CommitEnv>(
+        &self,
+        env: &E,
+        batch: Batch<{ BatchType::Write }>,
+        options: &WriteOptions,
+    ) -> Result<KeyTimestamp> {
+        if batch.is_empty() {
+            return Ok(self.visible_seq());
+        }
+        let start = Instant::now();
+        let result = self.commit_batch(env, batch, options);
+        self.commit_latency.record(start.elapsed());
+        result
+    }
+
+    fn commit_batch<E: CommitEnv>(
+        &self,
+        env: &E,
+        batch: Batch<{ BatchType::Write }>,
+        options: &WriteOptions,
+    ) -> Result<KeyTimestamp> {
+        let mut queue = self.queue.lock();
+        let request = Arc::new(CommitRequest {
+            batch,
+            sync: options.sync,
+            caller: options.caller,
+            ticket: self.next_ticket.fetch_add(1, Ordering::Relaxed),
+            seq: AtomicU64::new(0),
+            state: Mutex::new(CommitState::Queued),
+        });
+        queue.push_back(request.clone());
+        loop {
+            let mut state = request.state.lock();
+            match &mut *state {
+                CommitState::Queued if Arc::ptr_eq(&queue[0], &request) => {
+                    drop(state);
+                    break;
+                }
+                CommitState::Queued | CommitState::Applied(_) => {
+                    drop(state);
+                    self.changed.wait(&mut queue);
+                }
+                CommitState::Apply => {
+                    drop(state);
+                    drop(queue);
+                    let result = env.apply(&request.batch, request.seq.load(Ordering::Relaxed));
+                    queue = self.queue.lock();
+                    *request.state.lock() = CommitState::Applied(result);
+                    self.changed.notify_all();
+                }
+                CommitState::Done(result) => {
+                    let result = std::mem::replace(result, Ok(()));
+                    return result.map(|()| request.seq.load(Ordering::Relaxed));
+                }
+            }
+        }
+
+        // This writer leads the group of everything queued that fits within the byte limit. Batch
+        // sizes are kept as the batches are built, so forming the group costs the queue lock
+        // little.
+        let group = form_group(&queue);
+        drop(queue);
+
+        let mut seq = self.assigned_seq.load(Ordering::Relaxed) + 1;
+        let mut records = Vec::with_capacity(group.len());
+        for member in &group {
+            let mut record = Vec::new();
+            member.batch.encode(seq, &mut record);
+            records.push(record);
+            member.seq.store(seq, Ordering::Relaxed);
+            seq += member.count();
+        }
+        let last_seq = seq - 1;
+        self.assigned_seq.store(last_seq, Ordering::Relaxed);
+
+        let sync = group.iter().any(|member| member.sync);
+        if let Err(e) = env.write(&records, last_seq, sync) {
+            self.finish(&group, |_| Err(anyhow!("commit group failed to log: {e:#}")));
+            return Err(e);
+        }
+        self.logged_seq.store(last_seq, Ordering::Release);
+
+        // Hand each follower its batch to apply while the leader applies its own.
+        {
+            let _queue = self.queue.lock();
+            for follower in &group[1..] {
+                *follower.state.lock() = CommitState::Apply;
+            }
+            self.changed.notify_all();
+        }
+        let result = env.apply(&request.batch, request.seq.load(Ordering::Relaxed));
+
+        let mut queue = self.queue.lock();
+        while group[1..]
+            .iter()
+            .any(|follower| !matches!(*follower.state.lock(), CommitState::Applied(_)))
+        {
+            self.changed.wait(&mut queue);
+        }
+        self.visible_seq.store(last_seq, Ordering::Release);
+        drop(queue);
+
+        self.finish(&group, |member| {
+            match std::mem::replace(&mut *member.state.lock(), CommitState::Queued) {
+                CommitState::Applied(result) => result,
+                _ => Ok(()),
+            }
+        });
+        result.map(|()| request.seq.load(Ordering::Relaxed))
+    }
+
+    /// Removes the group from the queue, completes each follower with the result produced by
+    /// `result`, and wakes the next leader.
+    fn finish<F>(&self, group: &[Arc<CommitRequest>], mut result: F)
+    where
+        F: FnMut(&CommitRequest) -> Result<()>,
+    {
+        let mut queue = self.queue.lock();
+        // The group was taken from the queue in order, so it can be removed in a single pass.
+        let mut members = group.iter().peekable();
+        queue.retain(|queued| match members.peek() {
+            Some(member) if Arc::ptr_eq(member, queued) => {
+                members.next();
+                false
+            }
+            _ => true,
+        });
+        for follower in &group[1..] {
+            let result = result(follower);
+            *follower.state.lock() = CommitState::Done(result);
+        }
+        self.changed.notify_all();
+    }
+}
+
+/// Picks the group led by the batch at the front of the queue, returned in queue order. Batches
+/// are taken in queue order, except that those of identified callers are taken round-robin.
+fn form_group(queue: &VecDeque<Arc<CommitRequest>>) -> Vec<Arc<CommitRequest>> {
+    if queue.iter().all(|request| request.caller.is_none()) {
+        return fill_group(queue.iter());
+    }
+
+    // Rank each batch by the number of batches its caller has queued ahead of it. Batches without
+    // a caller are ranked first, like the first batch of a caller.
+    let mut queued = HashMap::new();
+    let mut ranked: Vec<_> = queue
+        .iter()
+        .map(|request| {
+            let rank = request.caller.map_or(0, |caller| {
+                let count = queued.entry(caller).or_insert(0);
+                *count += 1;
+                *count - 1
+            });
+            (rank, request)
+        })
+        .collect();
+    // The sort is stable, so batches of the same rank stay in queue order and the leader stays
+    // first.
+    ranked.sort_by_key(|(rank, _)| *rank);
+    let mut group = fill_group(ranked.into_iter().map(|(_, request)| request));
+    group.sort_by_key(|member| member.ticket);
+    group
+}
+
+/// Takes `candidates` into a group in order until it reaches the byte limit, passing over those
+/// that do not fit. The first candidate is always taken.
+fn fill_group<'a>(
+    candidates: impl Iterator<Item = &'a Arc<CommitRequest>>,
+) -> Vec<Arc<CommitRequest>> {
+    let mut group = Vec::new();
+    let mut group_bytes = 0;
+    for queued in candidates {
+        if group_bytes >= MAX_GROUP_BYTES {
+            break;
+        }
+        let size = queued.batch.approximate_size();
+        if !group.is_empty() && group_bytes + size > MAX_GROUP_BYTES {
+            continue;
+        }
+        group_bytes += size;
+        group.push(queued.clone());
+    }
+    group
+}
+
+#[cfg(test)]
+mod tests {
+    use bytes::Bytes;
+
+    use super::*;
+
+    fn queue(batches: &[(Option<u64>, usize)]) -> VecDeque<Arc<CommitRequest>> {
+        batches
+            .iter()
+            .enumerate()
+            .map(|(i, &(caller, size))| {
+                let mut batch = Batch::write();
+                let key = Bytes::from(format!("{i:08}"));
+                batch.insert(key.clone(), Bytes::from(vec![0; size - key.len()]));
+                Arc::new(CommitRequest {
+                    batch,
+                    sync: false,
+                    caller,
+                    ticket: i as u64,
+                    seq: AtomicU64::new(0),
+                    state: Mutex::new(CommitState::Queued),
+                })
+            })
+            .collect()
+    }
+
+    fn tickets(group: &[Arc<CommitRequest>]) -> Vec<u64> {
+        group.iter().map(|member| member.ticket).collect()
+    }
+
+    #[test]
+    fn heavy_caller_does_not_starve_light_one() {
+        const HEAVY: usize = MAX_GROUP_BYTES / 4;
+        let mut batches = vec![(Some(1), HEAVY); 8];
+        batches.push((Some(2), 16));
+
+        // Taken in queue order, the heavy caller's batches fill every group until its queue
+        // drains.
+        let anonymous: Vec<_> = batches.iter().map(|&(_, size)| (None, size)).collect();
+        assert_eq!(tickets(&form_group(&queue(&anonymous))), [0, 1, 2, 3]);
+
+        // Taken round-robin, the light caller's batch goes out with the first group.
+        assert_eq!(tickets(&form_group(&queue(&batches))), [0, 1, 2, 8]);
+    }
+
+    #[test]
+    fn fair_groups_keep_leader_and_queue_order() {
+        let batches = [(Some(1), 16), (Some(1), 16), (None, 16), (Some(2), 16), (Some(2), 16)];
+        assert_eq!(tickets(&form_group(&queue(&batches))), [0, 1, 2, 3, 4]);
+    }
+}
@@ -0,0 +1,455 @@
+use std::collections::VecDeque;
+use std::sync::Arc;
+
+use anyhow::Result;
+use bytes::Bytes;
+
+use crate::clock::to_unix_millis;
+use crate::invariants::{self, Checked};
+use crate::iterator::TraitIterator;
+use crate::key::{KeyKind, KeySlice, KeyTimestamp, KeyTrailer, KeyVec, TIMESTAMP_RANGE_END};
+use crate::merge::MergeOperator;
+use crate::options::Options;
+use crate::range_tombstone::RangeTombstones;
+
+/// Rewrites the point entries of a flush or compaction, dropping the versions no reader can see.
+///
+/// Open snapshots split the versions of a key into stripes: the versions no newer than the oldest
+/// snapshot, those between it and the next snapshot, and so on up to the versions newer than every
+/// snapshot. A reader only ever sees the newest version in its stripe, so only that version needs
+/// to be kept. Merge operands at the top of a stripe are folded into the value beneath them, and
+/// archive markers are kept along with the version they hide. Versions covered by a range deletion
+/// a stripe's readers can see are dropped, and operands above such a deletion are folded onto
+/// nothing, just as [`MemoryTable::get`](crate::mem_table::MemoryTable::get) reads them.
+///
+/// When the output is written to the bottom of the tree, nothing lies beneath it. Deletions with
+/// nothing left to shadow are dropped, merges without a base are folded onto nothing, values that
+/// have expired by the options' clock are deleted, and, if [`Options::zero_seqnums`] is set, the
+/// oldest value of a key has its sequence number zeroed once every snapshot can see it.
+///
+/// Entries are produced in the order they were read, with each key's versions oldest first. Range
+/// deletions are not seen by point iterators and must be carried over separately.
+#[allow(dead_code, reason = "staged for flushes and compactions, which do not exist yet")]
+pub struct CompactionIterator<I> {
+    iter: Checked<I>,
+    range_deletions: Arc<RangeTombstones>,
+    merge_operator: Arc<dyn MergeOperator>,
+    /// The time, in milliseconds since the Unix epoch, at and after which expiring values are
+    /// dropped from the bottom of the tree.
+    now: u64,
+    /// Sequence numbers of the open snapshots in ascending order.
+    snapshots: Vec<KeyTimestamp>,
+    /// The snapshots as passed in, for checking zeroing independently of the stripes.
+    #[cfg(feature = "invariants")]
+    input_snapshots: Vec<KeyTimestamp>,
+    bottommost: bool,
+    zero_seqnums: bool,
+    /// The surviving versions of the current key, oldest first.
+    pending: VecDeque<(KeyVec, Bytes)>,
+}
+
+#[allow(dead_code, reason = "staged for flushes and compactions, which do not exist yet")]
+impl<I> CompactionIterator<I>
+where
+    I: 'static + for<'a> TraitIterator<KeyType<'a> = KeySlice<'a>>,
+{
+    /// Wraps `iter`, which must already be positioned at its first entry. `range_deletions` holds
+    /// the range deletions written alongside the entries of `iter`.
+    pub fn new(
+        iter: I,
+        range_deletions: Arc<RangeTombstones>,
+        mut snapshots: Vec<KeyTimestamp>,
+        bottommost: bool,
+        options: &Options,
+    ) -> Result<Self> {
+        #[cfg(feature = "invariants")]
+        let input_snapshots = snapshots.clone();
+        snapshots.sort_unstable();
+        snapshots.dedup();
+        let mut compaction = CompactionIterator {
+            iter: invariants::check(iter),
+            range_deletions,
+            merge_operator: options.merge_operator.clone(),
+            now: to_unix_millis(options.clock.now()),
+            snapshots,
+            #[cfg(feature = "invariants")]
+            input_snapshots,
+            bottommost,
+            zero_seqnums: options.zero_seqnums,
+            pending: VecDeque::new(),
+        };
+        compaction.fill()?;
+        Ok(compaction)
+    }
+
+    /// Returns the index of the stripe holding `ts`. Newer stripes have higher indexes.
+    fn stripe(&self, ts: KeyTimestamp) -> usize {
+        self.snapshots.partition_point(|snapshot| *snapshot < ts)
+    }
+
+    /// Returns the newest timestamp readers in the stripe can read at.
+    fn stripe_read_ts(&self, stripe: usize) -> KeyTimestamp {
+        self.snapshots.get(stripe).copied().unwrap_or(TIMESTAMP_RANGE_END)
+    }
+
+    /// Reads keys from the input until one has a version that survives.
+    fn fill(&mut self) -> Result<()> {
+        while self.pending.is_empty() && self.iter.is_valid() {
+            // Read every version of the key, then order them newest first.
+            let user_key = self.iter.key().key_ref().to_vec();
+            let mut versions = Vec::new();
+            while self.iter.is_valid() && self.iter.key().key_ref() == user_key.as_slice() {
+                let trailer = self.iter.key().trailer();
+                versions.push((trailer, Bytes::copy_from_slice(self.iter.value())));
+                self.iter.next()?;
+            }
+            versions.reverse();
+
+            let mut kept = Vec::new();
+            let mut start = 0;
+            while start < versions.len() {
+                let stripe = self.stripe(versions[start].0.timestamp());
+                let len = versions[start..]
+                    .iter()
+                    .take_while(|(trailer, _)| self.stripe(trailer.timestamp()) == stripe)
+                    .count();
+                let oldest = start + len == versions.len();
+                let stripe_versions = &versions[start..start + len];
+                // Only a deletion inside the stripe settles what its readers see. One from an
+                // older stripe leaves the versions between it and the stripe visible.
+                let deleted_at = self
+                    .range_deletions
+                    .covering_ts(&user_key, self.stripe_read_ts(stripe))
+                    .filter(|deleted_at| self.stripe(*deleted_at) == stripe);
+                self.collapse(&user_key, stripe_versions, oldest, deleted_at, &mut kept)?;
+                start += len;
+            }
+
+            if self.bottommost {
+                while let Some((trailer, _)) = kept.last() {
+                    if !matches!(trailer.kind(), KeyKind::Delete) {
+                        break;
+                    }
+                    kept.pop();
+                }
+                #[cfg(feature = "invariants")]
+                let unzeroed: Vec<_> = kept.iter().map(|(t, _)| t.timestamp()).collect();
+                if let Some((trailer, _)) = kept.last_mut().filter(|_| self.zero_seqnums) {
+                    let is_value = matches!(trailer.kind(), KeyKind::Set | KeyKind::SetWithExpiry);
+                    if is_value && self.stripe(trailer.timestamp()) == 0 {
+                        // Zeroing makes the version visible to every snapshot, including any
+                        // older than it that must not see it. Only once no snapshot predates the
+                        // version is it safe.
+                        *trailer = KeyTrailer::new(0, trailer.kind());
+                    }
+                }
+                #[cfg(feature = "invariants")]
+                self.check_zeroing(&unzeroed, &kept);
+            }
+
+            self.pending.extend(kept.into_iter().rev().map(|(trailer, value)| {
+                (KeyVec::from_vec(user_key.clone(), trailer), value)
+            }));
+        }
+        Ok(())
+    }
+
+    /// Appends the versions of a single stripe, newest first, that readers in the stripe can see.
+    /// `oldest` is set for the stripe holding the oldest version of the key, and `deleted_at` is
+    /// the timestamp of the newest range deletion in the stripe covering the key.
+    fn collapse(
+        &self,
+        user_key: &[u8],
+        versions: &[(KeyTrailer, Bytes)],
+        oldest: bool,
+        deleted_at: Option<KeyTimestamp>,
+        kept: &mut Vec<(KeyTrailer, Bytes)>,
+    ) -> Result<()> {
+        let mut operands: Vec<&(KeyTrailer, Bytes)> = Vec::new();
+        for version @ (trailer, value) in versions {
+            if deleted_at.is_some_and(|deleted_at| trailer.timestamp() <= deleted_at) {
+                break;
+            }
+            let existing = match trailer.kind() {
+                KeyKind::Merge => {
+                    operands.push(version);
+                    continue;
+                }
+                KeyKind::Archive => {
+                    // The marker hides the versions beneath it rather than replacing them, so
+                    // keep looking for the value it hides.
+                    kept.extend(operands.drain(..).cloned());
+                    kept.push(version.clone());
+                    continue;
+                }
+                KeyKind::Set => Some(value.as_ref()),
+                KeyKind::Delete | KeyKind::RangeDelete => None,
+                // Nothing beneath the bottom of the tree can be exposed by dropping an expired
+                // value, so it is deleted for good there.
+                KeyKind::SetWithExpiry if self.bottommost && self.expired(value) => {
+                    match operands.first() {
+                        Some((newest, _)) => {
+                            let value = self.fold(user_key, None, &operands)?;
+                            kept.push((KeyTrailer::new(newest.timestamp(), KeyKind::Set), value));
+                        }
+                        None => {
+                            let deletion = KeyTrailer::new(trailer.timestamp(), KeyKind::Delete);
+                            kept.push((deletion, Bytes::new()));
+                        }
+                    }
+                    return Ok(());
+                }
+                // Above the bottom of the tree, folding onto an expiring value would have to
+                // decide whether it will have expired by the time it is read, so leave it to
+                // readers.
+                KeyKind::SetWithExpiry => {
+                    kept.extend(operands.drain(..).cloned());
+                    kept.push(version.clone());
+                    return Ok(());
+                }
+            };
+
+            match operands.first() {
+                Some((newest, _)) => {
+                    let value = self.fold(user_key, existing, &operands)?;
+                    kept.push((KeyTrailer::new(newest.timestamp(), KeyKind::Set), value));
+                }
+                None => kept.push(version.clone()),
+            }
+            return Ok(());
+        }
+
+        // The stripe ended without a value or point deletion beneath the operands. Unless a range
+        // deletion or the bottom of the tree lies beneath them, the operands have to wait for a
+        // later compaction to fold them.
+        match operands.first() {
+            Some((newest, _)) if deleted_at.is_some() || (oldest && self.bottommost) => {
+                let value = self.fold(user_key, None, &operands)?;
+                kept.push((KeyTrailer::new(newest.timestamp(), KeyKind::Set), value));
+            }
+            _ => kept.extend(operands.into_iter().cloned()),
+        }
+        Ok(())
+    }
+
+    /// Panics if zeroing changed the version any snapshot reads, or happened above the bottom of
+    /// the tree where older versions may lie beneath. `unzeroed` holds the timestamps of `kept`
+    /// before zeroing. The snapshots are checked as they were passed in, independently of the
+    /// stripes zeroing was decided by.
+    #[cfg(feature = "invariants")]
+    fn check_zeroing(&self, unzeroed: &[KeyTimestamp], kept: &[(KeyTrailer, Bytes)]) {
+        let zeroed = unzeroed.iter().zip(kept).any(|(ts, (trailer, _))| *ts != trailer.timestamp());
+        if !zeroed {
+            return;
+        }
+        assert!(self.bottommost, "zeroed a sequence number above the bottom of the tree");
+        for snapshot in &self.input_snapshots {
+            let before = unzeroed.iter().position(|ts| ts <= snapshot);
+            let after = kept.iter().position(|(trailer, _)| trailer.timestamp() <= *snapshot);
+            assert_eq!(before, after, "zeroing changed the version snapshot {snapshot} reads");
+        }
+    }
+
+    /// Returns whether an expiring value, as stored with its expiry, has expired.
+    fn expired(&self, value: &Bytes) -> bool {
+        let expires_at = u64::from_le_bytes(value[..size_of::<u64>()].try_into().unwrap());
+        expires_at <= self.now
+    }
+
+    /// Folds operands, given newest first, onto an existing value.
+    fn fold(
+        &self,
+        user_key: &[u8],
+        existing: Option<&[u8]>,
+        operands: &[&(KeyTrailer, Bytes)],
+    ) -> Result<Bytes> {
+        let operands: Vec<&[u8]> = operands.iter().rev().map(|(_, value)| value.as_ref()).collect();
+        let value = self.merge_operator.full_merge(user_key, existing, &operands)?;
+        Ok(value.into())
+    }
+}
+
+impl<I> TraitIterator for CompactionIterator<I>
+where
+    I: 'static + for<'a> TraitIterator<KeyType<'a> = KeySlice<'a>>,
+{
+    type KeyType<'a> = KeySlice<'a>;
+
+    fn is_valid(&self) -> bool {
+        !self.pending.is_empty()
+    }
+
+    fn value(&self) -> &[u8] {
+        &self.pending[0].1
+    }
+
+    fn key(&self) -> KeySlice<'_> {
+        self.pending[0].0.as_key_slice()
+    }
+
+    fn next(&mut self) -> Result<()> {
+        self.pending.pop_front();
+        self.fill()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::{Duration, UNIX_EPOCH};
+
+    use super::*;
+    use crate::clock::ManualClock;
+    use crate::key::KeyBytes;
+    use crate::mem_table::MemoryTable;
+
+    fn key(key: &'static str, ts: KeyTimestamp, kind: KeyKind) -> KeyBytes {
+        KeyBytes::from_bytes(Bytes::from(key), KeyTrailer::new(ts, kind))
+    }
+
+    fn compact(
+        memtable: &MemoryTable,
+        snapshots: Vec<KeyTimestamp>,
+        bottommost: bool,
+        options: &Options,
+    ) -> Vec<(String, KeyTimestamp, KeyKind, Bytes)> {
+        let mut iter = memtable.iter();
+        iter.first();
+        let range_deletions = memtable.range_deletions();
+        let mut compaction =
+            CompactionIterator::new(iter, range_deletions, snapshots, bottommost, options).unwrap();
+        let mut out = Vec::new();
+        while compaction.is_valid() {
+            let key = compaction.key();
+            let user_key = String::from_utf8(key.key_ref().to_vec()).unwrap();
+            let value = Bytes::copy_from_slice(compaction.value());
+            out.push((user_key, key.timestamp(), key.kind(), value));
+            compaction.next().unwrap();
+        }
+        out
+    }
+
+    #[test]
+    fn range_deletion_hides_value_beneath_merge() {
+        let memtable = MemoryTable::new(0);
+        memtable.put(key("a", 10, KeyKind::Set), Bytes::from("v10")).unwrap();
+        memtable.delete_range(key("a", 15, KeyKind::RangeDelete), Bytes::from("b")).unwrap();
+        memtable.put(key("a", 20, KeyKind::Merge), Bytes::from("m20")).unwrap();
+
+        let options = Options {
+            zero_seqnums: false,
+            ..Options::default()
+        };
+        for bottommost in [false, true] {
+            assert_eq!(
+                compact(&memtable, vec![], bottommost, &options),
+                vec![("a".into(), 20, KeyKind::Set, Bytes::from("m20"))],
+            );
+        }
+    }
+
+    #[test]
+    fn range_deletion_respects_snapshots() {
+        let memtable = MemoryTable::new(0);
+        memtable.put(key("a", 10, KeyKind::Set), Bytes::from("v10")).unwrap();
+        memtable.delete_range(key("a", 15, KeyKind::RangeDelete), Bytes::from("b")).unwrap();
+        memtable.put(key("a", 20, KeyKind::Merge), Bytes::from("m20")).unwrap();
+
+        // A snapshot at 12 predates the deletion and still reads the value beneath it.
+        let options = Options {
+            zero_seqnums: false,
+            ..Options::default()
+        };
+        assert_eq!(
+            compact(&memtable, vec![12], true, &options),
+            vec![
+                ("a".into(), 10, KeyKind::Set, Bytes::from("v10")),
+                ("a".into(), 20, KeyKind::Set, Bytes::from("m20")),
+            ],
+        );
+    }
+
+    #[test]
+    fn expired_values_dropped_at_bottom() {
+        let clock = Arc::new(ManualClock::new(UNIX_EPOCH + Duration::from_millis(1000)));
+        let options = Options {
+            clock: clock.clone(),
+            ..Options::default()
+        };
+        let expiring = |expires_at: u64, value: &str| {
+            let mut stored = expires_at.to_le_bytes().to_vec();
+            stored.extend_from_slice(value.as_bytes());
+            Bytes::from(stored)
+        };
+
+        let memtable = MemoryTable::new(0);
+        memtable.put(key("a", 1, KeyKind::Set), Bytes::from("a1")).unwrap();
+        memtable.put(key("a", 2, KeyKind::SetWithExpiry), expiring(1000, "a2")).unwrap();
+        memtable.put(key("b", 3, KeyKind::SetWithExpiry), expiring(1000, "b3")).unwrap();
+        memtable.put(key("b", 4, KeyKind::Merge), Bytes::from("m4")).unwrap();
+        memtable.put(key("c", 5, KeyKind::SetWithExpiry), expiring(2000, "c5")).unwrap();
+
+        assert_eq!(
+            compact(&memtable, vec![], true, &options),
+            vec![
+                ("b".into(), 0, KeyKind::Set, Bytes::from("m4")),
+                ("c".into(), 0, KeyKind::SetWithExpiry, expiring(2000, "c5")),
+            ],
+        );
+
+        // Above the bottom the expired values are left for readers to skip.
+        let out = compact(&memtable, vec![], false, &options);
+        assert_eq!(out.len(), 4);
+        assert_eq!((out[0].1, out[0].2), (2, KeyKind::SetWithExpiry));
+    }
+
+    /// Compacts a single value written at `ts` into the bottom of the tree and returns the
+    /// sequence number it is written with.
+    fn zeroed_seqnum(ts: KeyTimestamp, snapshots: Vec<KeyTimestamp>, bottommost: bool) -> u64 {
+        let memtable = MemoryTable::new(0);
+        memtable.put(key("a", ts, KeyKind::Set), Bytes::from("v")).unwrap();
+        compact(&memtable, snapshots, bottommost, &Options::default())[0].1
+    }
+
+    #[test]
+    fn zeroing_respects_snapshots() {
+        // No snapshots.
+        assert_eq!(zeroed_seqnum(5, vec![], true), 0);
+        // A snapshot at the version's own sequence number can already see it.
+        assert_eq!(zeroed_seqnum(5, vec![5], true), 0);
+        // A snapshot just below the version must not start seeing it.
+        assert_eq!(zeroed_seqnum(5, vec![4], true), 5);
+        // Unsorted and duplicated snapshots are ordered before striping.
+        assert_eq!(zeroed_seqnum(5, vec![9, 4, 9, 7], true), 5);
+        assert_eq!(zeroed_seqnum(5, vec![9, 6, 9, 7], true), 0);
+        // Older versions may lie beneath output above the bottom of the tree.
+        assert_eq!(zeroed_seqnum(5, vec![], false), 5);
+        // Zeroing can be turned off.
+        let memtable = MemoryTable::new(0);
+        memtable.put(key("a", 5, KeyKind::Set), Bytes::from("v")).unwrap();
+        let options = Options {
+            zero_seqnums: false,
+            ..Options::default()
+        };
+        assert_eq!(compact(&memtable, vec![], true, &options)[0].1, 5);
+    }
+
+    #[test]
+    fn zeroing_only_oldest_version() {
+        let memtable = MemoryTable::new(0);
+        memtable.put(key("a", 3, KeyKind::Set), Bytes::from("v3")).unwrap();
+        memtable.put(key("a", 8, KeyKind::Set), Bytes::from("v8")).unwrap();
+
+        // The snapshot at 5 keeps v3 alive, and is older than v8, so only v3 is zeroed.
+        assert_eq!(
+            compact(&memtable, vec![5], true, &Options::default()),
+            vec![
+                ("a".into(), 0, KeyKind::Set, Bytes::from("v3")),
+                ("a".into(), 8, KeyKind::Set, Bytes::from("v8")),
+            ],
+        );
+
+        // A deletion left at the bottom is dropped, exposing nothing to zero.
+        memtable.delete(key("a", 9, KeyKind::Delete)).unwrap();
+        assert_eq!(compact(&memtable, vec![], true, &Options::default()), vec![]);
+    }
+}
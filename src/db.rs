@@ -1,39 +1,1098 @@
-use anyhow::Result;
-use bytes::Bytes;
+use std::fs::{self, OpenOptions};
+use std::io::{self, Read, Write};
+use std::collections::{BTreeMap, BTreeSet};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::Duration;
 
-use crate::batch::{Batch, BatchType};
-use crate::transaction::Transaction;
+use anyhow::{anyhow, Context, Result};
+use bytes::buf::Reader;
+use bytes::{Buf, Bytes};
+use parking_lot::{Mutex, RwLock};
+
+use crate::batch::{Batch, BatchType, BatchWriter};
+use crate::clock::to_unix_millis;
+use crate::commit::{CommitEnv, CommitPipeline};
+use crate::error::CorruptionError;
+use crate::export::{ExportReader, ExportWriter};
+use crate::iterator::TraitIterator;
+use crate::key::{KeyBytes, KeyKind, KeySlice, KeyTimestamp, KeyTrailer};
+use crate::lock::LockManager;
+use crate::mem_table::{Lookup, MemoryTable};
+use crate::merge::{ConcatOperator, CounterOperator, MergeOperator};
+use crate::metrics::{MemTableMetrics, Metrics, SeqNums, WalMetrics};
+use crate::options::{Options, ReadOptions, WriteOptions};
+use crate::reservation::{RangeReservation, Reservations};
+use crate::resource::{Resource, ResourceGuard, ResourceTracker, ResourceUsage};
+use crate::transaction::{Consistency, Transaction, TransactionConflictError};
+use crate::wal::{WalReader, WalSyncer, WalWriter};
+
+/// The result of probing a database with [`DB::health`].
+#[derive(Clone, Debug, Eq, PartialEq)]
+pub struct HealthStatus {
+    /// Whether buffered log records could be handed to the operating system, and the log file
+    /// still holds every record appended to it.
+    pub wal_writable: bool,
+    /// Whether the data directory could be read.
+    pub directory_accessible: bool,
+    /// The error that stopped the database from accepting writes, if any.
+    pub background_error: Option<String>,
+}
+
+impl HealthStatus {
+    /// Returns true if the database is able to serve reads and writes.
+    pub fn is_healthy(&self) -> bool {
+        self.wal_writable && self.directory_accessible && self.background_error.is_none()
+    }
+}
+
+/// Streams a value returned by [`DB::get_reader`].
+pub struct ValueReader {
+    inner: Reader<Bytes>,
+}
+
+impl ValueReader {
+    /// Returns the number of bytes left to read.
+    pub fn remaining(&self) -> usize {
+        self.inner.get_ref().remaining()
+    }
+}
+
+impl Read for ValueReader {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        self.inner.read(buf)
+    }
+}
 
 pub struct DB {
+    path: PathBuf,
+    options: Options,
+    resources: Arc<ResourceTracker>,
+    pipeline: CommitPipeline,
+    reservations: Arc<Reservations>,
+    /// Held shared by every write from admission until commit, and exclusively by transactions
+    /// while they check for conflicts and commit, so that no write can land in between.
+    commit_gate: RwLock<()>,
+    locks: LockManager,
+    memtable: RwLock<Arc<MemoryTable>>,
+    wal: Arc<Mutex<WalWriter>>,
+    _wal_file: ResourceGuard,
+    /// The number of log files in the directory: the live log and any older logs replayed when
+    /// the database was opened. Logs are only created or removed at open.
+    wal_files: usize,
+    wal_syncer: WalSyncer,
+    /// Set when a failure leaves the database unable to accept writes, such as a log write whose
+    /// outcome is unknown. Once set, every write fails with this error.
+    background_error: Arc<Mutex<Option<String>>>,
+}
+
+/// How many times [`DB::run_transaction`] retries a transaction that failed to commit because of
+/// a conflict.
+const MAX_TRANSACTION_RETRIES: usize = 10;
+
+/// The size of the batches [`DB::import`] commits entries in.
+const IMPORT_BATCH_BYTES: usize = 1 << 20;
+
+fn wal_path(dir: &Path, id: usize) -> PathBuf {
+    dir.join(format!("{:06}.wal", id))
+}
 
+/// Returns the ids of the write-ahead logs in the directory in ascending order. The directory is
+/// held open against the open file limit while it is read.
+fn list_wals(dir: &Path, resources: &Arc<ResourceTracker>) -> Result<Vec<usize>> {
+    let _dir = resources.acquire(Resource::OpenFiles, 1)?;
+    let mut ids = Vec::new();
+    for entry in fs::read_dir(dir)? {
+        let name = entry?.file_name();
+        let Some(id) = name
+            .to_str()
+            .and_then(|name| name.strip_suffix(".wal"))
+            .and_then(|id| id.parse().ok())
+        else {
+            continue;
+        };
+        ids.push(id);
+    }
+    ids.sort_unstable();
+    Ok(ids)
 }
 
 impl DB {
-    pub fn open() -> Self {
-        unimplemented!()
+    pub fn open<P: AsRef<Path>>(path: P) -> Result<Self> {
+        Self::open_with_options(path, Options::default())
     }
 
-    pub fn apply_batch<const T: BatchType>(&self, _batch: Batch<T>) -> Result<()> {
-        unimplemented!()
+    /// Opens the database in the directory at `path`, creating it if necessary. Batches left in
+    /// the write-ahead log by a previous process are replayed into the memtable.
+    pub fn open_with_options<P: AsRef<Path>>(path: P, options: Options) -> Result<Self> {
+        let path = path.as_ref().to_path_buf();
+        fs::create_dir_all(&path)
+            .with_context(|| format!("failed to create {}", path.display()))?;
+
+        let resources = Arc::new(ResourceTracker::new(&options));
+        let wal_ids = list_wals(&path, &resources)?;
+        let memtable_id = wal_ids.last().copied().unwrap_or(0);
+        let memtable = MemoryTable::new(memtable_id);
+
+        let logger = options.logger.clone();
+        let mut last_seq = 0;
+        for &id in &wal_ids {
+            let log = wal_path(&path, id);
+            let end = {
+                let _reader_file = resources.acquire(Resource::OpenFiles, 1)?;
+                let mut reader = WalReader::open(&log, options.paranoid_checks)?;
+                let mut batches = 0;
+                while let Some(record) = reader.next_record()? {
+                    let (seq, batch) = Batch::decode(&record)
+                        .with_context(|| format!("failed to replay {}", log.display()))?;
+                    apply_to(&memtable, &batch, seq)?;
+                    last_seq = last_seq.max(seq + batch.len() as u64 - 1);
+                    batches += 1;
+                }
+                logger.info(format_args!("replayed {batches} batches from {}", log.display()));
+                reader.offset()
+            };
+
+            // Drop anything after the last complete record so that new records appended to the
+            // log are not hidden behind a torn write.
+            let _truncate_file = resources.acquire(Resource::OpenFiles, 1)?;
+            let file = OpenOptions::new().write(true).open(&log)?;
+            let torn = file.metadata()?.len().saturating_sub(end);
+            if torn > 0 {
+                logger.info(format_args!(
+                    "truncating {torn} bytes of torn writes from {}",
+                    log.display()
+                ));
+            }
+            file.set_len(end)?;
+        }
+
+        let wal_file = resources.acquire(Resource::OpenFiles, 1)?;
+        let wal = Arc::new(Mutex::new(WalWriter::create(wal_path(&path, memtable_id), last_seq)?));
+
+        let background_error = Arc::new(Mutex::new(None));
+        let wal_syncer = WalSyncer::start(
+            wal.clone(),
+            options.wal_sync_interval,
+            resources.acquire(Resource::BackgroundThreads, 1)?,
+            options.abort_on_background_panic,
+            logger.clone(),
+            {
+                let background_error = background_error.clone();
+                let logger = logger.clone();
+                move |e| {
+                    logger.error(format_args!("wal sync failed: {e:#}"));
+                    background_error
+                        .lock()
+                        .get_or_insert_with(|| format!("wal sync failed: {e:#}"));
+                }
+            },
+        )?;
+        logger.info(format_args!("opened {} at seqnum {last_seq}", path.display()));
+
+        Ok(DB {
+            path,
+            locks: LockManager::new(options.lock_timeout),
+            options,
+            resources,
+            pipeline: CommitPipeline::new(last_seq),
+            reservations: Arc::new(Reservations::new()),
+            commit_gate: RwLock::new(()),
+            memtable: RwLock::new(Arc::new(memtable)),
+            wal,
+            _wal_file: wal_file,
+            wal_files: wal_ids.len().max(1),
+            wal_syncer,
+            background_error,
+        })
+    }
+
+    pub fn apply_batch<const T: BatchType>(&self, batch: Batch<T>) -> Result<()> {
+        self.apply_batch_opt(batch, &WriteOptions::default())
+    }
+
+    pub fn apply_batch_opt<const T: BatchType>(
+        &self,
+        batch: Batch<T>,
+        options: &WriteOptions,
+    ) -> Result<()> {
+        match T {
+            BatchType::Read => Err(anyhow!("read batches are read with DB::read_batch")),
+            BatchType::Write => {
+                let batch = Batch::<{ BatchType::Write }> {
+                    items: batch.items,
+                    range_deletes: batch.range_deletes,
+                    merges: batch.merges,
+                    expirations: batch.expirations,
+                    archived: batch.archived,
+                    size: batch.size,
+                };
+                let _gate = self.commit_gate.read();
+                self.write(batch, options, None)
+            }
+        }
     }
-    
-    pub fn transaction(&self) -> TransactionHandle {
-        unimplemented!()
+
+    /// Applies a batch on behalf of the holder of `reservation`, which is how a bulk load writes
+    /// into the range it reserved. The batch may write anywhere in the reserved range, but, like
+    /// any other write, not inside ranges reserved by others.
+    pub fn apply_batch_reserved(
+        &self,
+        reservation: &RangeReservation,
+        batch: Batch<{ BatchType::Write }>,
+        options: &WriteOptions,
+    ) -> Result<()> {
+        let _gate = self.commit_gate.read();
+        self.write(batch, options, Some(reservation))
+    }
+
+    /// Commits a write batch, allowing it to write inside the range held by `reservation`. The
+    /// caller must hold the commit gate.
+    fn write(
+        &self,
+        batch: Batch<{ BatchType::Write }>,
+        options: &WriteOptions,
+        reservation: Option<&RangeReservation>,
+    ) -> Result<()> {
+        if let Some(e) = &*self.background_error.lock() {
+            return Err(anyhow!("database is read-only after error: {e}"));
+        }
+        let _reservations = self.reservations.admit(&batch, reservation)?;
+        self.pipeline.commit(self, batch, options)?;
+        Ok(())
     }
-    
-    pub fn get(&self, _key: Bytes) {
-        unimplemented!()
+
+    /// Returns a writer that commits its updates in batches of roughly `auto_commit_bytes`.
+    pub fn batch_writer(&self, auto_commit_bytes: usize) -> BatchWriter<'_> {
+        self.batch_writer_opt(auto_commit_bytes, &WriteOptions::default())
+    }
+
+    pub fn batch_writer_opt(
+        &self,
+        auto_commit_bytes: usize,
+        options: &WriteOptions,
+    ) -> BatchWriter<'_> {
+        BatchWriter::new(self, auto_commit_bytes, *options)
+    }
+
+    /// Begins an optimistic transaction reading from the current state of the database.
+    pub fn transaction(&self) -> Transaction<'_> {
+        self.transaction_with(Consistency::Optimistic)
+    }
+
+    pub fn transaction_with(&self, consistency: Consistency) -> Transaction<'_> {
+        Transaction::new(self, consistency, self.pipeline.visible_seq())
+    }
+
+    /// Runs `f` in a transaction and commits it, retrying from the start with a fresh transaction
+    /// up to `MAX_TRANSACTION_RETRIES` times when the commit fails with a
+    /// [`TransactionConflictError`]. `f` must be safe to run more than once.
+    pub fn run_transaction<T, F>(&self, mut f: F) -> Result<T>
+    where
+        F: FnMut(&mut Transaction) -> Result<T>,
+    {
+        let mut attempt = 0;
+        loop {
+            let mut txn = self.transaction();
+            let result = f(&mut txn)?;
+            match txn.commit() {
+                Ok(()) => return Ok(result),
+                Err(e) if !e.is::<TransactionConflictError>() => return Err(e),
+                Err(e) if attempt == MAX_TRANSACTION_RETRIES => return Err(e),
+                Err(_) => attempt += 1,
+            }
+        }
+    }
+
+    /// Commits a transaction's writes if none of the keys it read have changed since `read_ts`.
+    pub(crate) fn commit_transaction(
+        &self,
+        read_ts: KeyTimestamp,
+        reads: &BTreeSet<Bytes>,
+        writes: Batch<{ BatchType::Write }>,
+        options: &WriteOptions,
+    ) -> Result<()> {
+        if writes.is_empty() {
+            return Ok(());
+        }
+        let _gate = self.commit_gate.write();
+        let memtable = self.memtable.read().clone();
+        for key in reads {
+            if memtable.newest_ts(key).is_some_and(|ts| ts > read_ts) {
+                return Err(TransactionConflictError { key: key.clone() }.into());
+            }
+        }
+        self.write(writes, options, None)
+    }
+
+    pub(crate) fn options(&self) -> &Options {
+        &self.options
+    }
+
+    pub(crate) fn locks(&self) -> &LockManager {
+        &self.locks
+    }
+
+    pub(crate) fn visible_seq(&self) -> KeyTimestamp {
+        self.pipeline.visible_seq()
+    }
+
+    /// Returns the newest value of the key, or `None` if it was never written, has expired, or has
+    /// since been deleted, whether directly or by a range deletion.
+    pub fn get<K: AsRef<[u8]>>(&self, key: K) -> Result<Option<Bytes>> {
+        self.get_opt(key, &ReadOptions::default())
+    }
+
+    pub fn get_opt<K: AsRef<[u8]>>(&self, key: K, options: &ReadOptions) -> Result<Option<Bytes>> {
+        let read_ts = self.pipeline.visible_seq();
+        self.get_at(key.as_ref(), read_ts, options.include_archived)
+    }
+
+    /// Reads every key in the batch as of a single point in time, returning each with its newest
+    /// value, or `None` if it does not exist.
+    pub fn read_batch(
+        &self,
+        batch: Batch<{ BatchType::Read }>,
+    ) -> Result<BTreeMap<Bytes, Option<Bytes>>> {
+        let read_ts = self.pipeline.visible_seq();
+        batch
+            .items
+            .into_keys()
+            .map(|key| {
+                let value = self.get_at(&key, read_ts, false)?;
+                Ok((key, value))
+            })
+            .collect()
+    }
+
+    /// Returns the value of the key as of `read_ts`.
+    pub(crate) fn get_at(
+        &self,
+        key: &[u8],
+        read_ts: KeyTimestamp,
+        include_archived: bool,
+    ) -> Result<Option<Bytes>> {
+        let now = to_unix_millis(self.options.clock.now());
+        let memtable = self.memtable.read().clone();
+        let key = KeySlice::from_slice(key, KeyTrailer::new(read_ts, KeyKind::Set));
+        let merge_operator = self.options.merge_operator.as_ref();
+        match memtable.get(key, merge_operator, now, include_archived)? {
+            Lookup::Value(value) => Ok(Some(value)),
+            Lookup::Deleted | Lookup::Missing => Ok(None),
+        }
     }
 
     pub fn insert(&self, key: Bytes, value: Bytes) -> Result<()> {
+        self.insert_opt(key, value, &WriteOptions::default())
+    }
+
+    pub fn insert_opt(&self, key: Bytes, value: Bytes, options: &WriteOptions) -> Result<()> {
         let mut batch  = Batch::write();
         batch.insert(key, value);
-        self.apply_batch(batch)
+        self.apply_batch_opt(batch, options)
+    }
+
+    /// Inserts a value that expires once `ttl` has passed on the database's
+    /// [`Clock`](crate::Clock), after which reads treat the key as deleted. Fails if the expiry
+    /// does not fit in a `SystemTime`.
+    pub fn insert_with_ttl(&self, key: Bytes, value: Bytes, ttl: Duration) -> Result<()> {
+        self.insert_with_ttl_opt(key, value, ttl, &WriteOptions::default())
+    }
+
+    pub fn insert_with_ttl_opt(
+        &self,
+        key: Bytes,
+        value: Bytes,
+        ttl: Duration,
+        options: &WriteOptions,
+    ) -> Result<()> {
+        let Some(expires_at) = self.options.clock.now().checked_add(ttl) else {
+            return Err(anyhow!("ttl of {ttl:?} is too long"));
+        };
+        let mut batch  = Batch::write();
+        batch.insert_with_expiry(key, value, expires_at);
+        self.apply_batch_opt(batch, options)
     }
 
     pub fn remove(&self, key: Bytes) -> Result<()> {
+        self.remove_opt(key, &WriteOptions::default())
+    }
+
+    pub fn remove_opt(&self, key: Bytes, options: &WriteOptions) -> Result<()> {
         let mut batch  = Batch::write();
         batch.remove(key);
-        self.apply_batch(batch)
+        self.apply_batch_opt(batch, options)
+    }
+
+    /// Hides the key from normal reads without deleting it, so that it can later be brought back
+    /// with [`DB::restore`]. Reads with [`ReadOptions::include_archived`] still see its value.
+    pub fn archive(&self, key: Bytes) -> Result<()> {
+        self.archive_opt(key, &WriteOptions::default())
+    }
+
+    pub fn archive_opt(&self, key: Bytes, options: &WriteOptions) -> Result<()> {
+        let mut batch  = Batch::write();
+        batch.archive(key);
+        self.apply_batch_opt(batch, options)
+    }
+
+    /// Makes an archived key visible to normal reads again by rewriting its archived value,
+    /// returning whether there was an archived value to restore. The read and the rewrite are not
+    /// atomic, so a write to the key made in between is overwritten.
+    pub fn restore(&self, key: Bytes) -> Result<bool> {
+        if self.get(&key)?.is_some() {
+            return Ok(false);
+        }
+        let options = ReadOptions { include_archived: true };
+        match self.get_opt(&key, &options)? {
+            Some(value) => {
+                self.insert(key, value)?;
+                Ok(true)
+            }
+            None => Ok(false),
+        }
+    }
+
+    /// Writes a single entry of any kind. See [`Batch::add`] for how the value is interpreted.
+    pub fn apply_kv(&self, kind: KeyKind, key: Bytes, value: Bytes) -> Result<()> {
+        self.apply_kv_opt(kind, key, value, &WriteOptions::default())
+    }
+
+    pub fn apply_kv_opt(
+        &self,
+        kind: KeyKind,
+        key: Bytes,
+        value: Bytes,
+        options: &WriteOptions,
+    ) -> Result<()> {
+        let mut batch = Batch::write();
+        batch.add(kind, key, value)?;
+        self.apply_batch_opt(batch, options)
+    }
+
+    /// Writes every key visible to normal reads to `w` as an export stream, returning the number
+    /// of keys written. The export reads a consistent view of the database taken when it begins,
+    /// so writes made while it runs are left out. Merges are folded into the values they apply to,
+    /// and values written with a TTL keep their expiration time. Archived keys are not exported.
+    pub fn export<W: Write>(&self, w: W) -> Result<u64> {
+        let read_ts = self.pipeline.visible_seq();
+        let now = to_unix_millis(self.options.clock.now());
+        let memtable = self.memtable.read().clone();
+        let merge_operator = self.options.merge_operator.as_ref();
+        let mut export = ExportWriter::new(w)?;
+        let mut iter = memtable.iter();
+        iter.first();
+        while iter.is_valid() {
+            let key = Bytes::copy_from_slice(iter.key().key_ref());
+            while iter.is_valid() && iter.key().key_ref() == key.as_ref() {
+                iter.next()?;
+            }
+
+            // The value and its expiry are read at the same time, so that a value whose base
+            // has expired, leaving only its merge operands, is not exported as expired.
+            let at = KeySlice::from_slice(&key, KeyTrailer::new(read_ts, KeyKind::Set));
+            let Lookup::Value(value) = memtable.get(at, merge_operator, now, false)? else {
+                continue;
+            };
+            match memtable.expires_at(at).filter(|expires_at| *expires_at > now) {
+                Some(expires_at) => {
+                    let mut expiring = Vec::with_capacity(size_of::<u64>() + value.len());
+                    expiring.extend_from_slice(&expires_at.to_le_bytes());
+                    expiring.extend_from_slice(&value);
+                    export.add(KeyKind::SetWithExpiry, &key, &expiring)?;
+                }
+                None => export.add(KeyKind::Set, &key, &value)?,
+            }
+        }
+        export.finish()
+    }
+
+    /// Writes the entries of an export stream made by [`DB::export`] into the database, returning
+    /// the number of entries imported. Entries are committed in batches as they are read, each
+    /// only after its checksum has been verified, so a damaged entry is never written. The import
+    /// is not atomic, though: if it fails part way, the batches committed before the failure stay
+    /// written.
+    pub fn import<R: Read>(&self, r: R) -> Result<u64> {
+        let mut export = ExportReader::new(r)?;
+        let mut writer = self.batch_writer(IMPORT_BATCH_BYTES);
+        let mut count = 0;
+        while let Some((kind, key, value)) = export.next_entry()? {
+            writer.add(kind, key, value)?;
+            count += 1;
+        }
+        writer.commit()?;
+        Ok(count)
+    }
+
+    /// Reserves the key range `[start, end)` until the returned reservation is dropped, so that a
+    /// bulk load can write the range through [`DB::apply_batch_reserved`] without concurrent
+    /// writes landing in it. Other writes to the range fail with a
+    /// [`RangeReservedError`](crate::RangeReservedError) in the meantime, as does reserving an
+    /// overlapping range. The reservation is granted once in-flight writes have committed.
+    pub fn reserve_range(&self, start: Bytes, end: Bytes) -> Result<RangeReservation> {
+        self.reservations.reserve(start, end)
+    }
+
+    /// Returns a reader over the newest value of the key, or `None` if it does not exist. The
+    /// reader shares the stored value rather than copying it, which suits large blob-style values
+    /// that are consumed incrementally.
+    pub fn get_reader<K: AsRef<[u8]>>(&self, key: K) -> Result<Option<ValueReader>> {
+        Ok(self.get(key)?.map(|value| ValueReader {
+            inner: value.reader(),
+        }))
+    }
+
+    /// Records a merge operand for the key, combined with its existing value by the configured
+    /// [`MergeOperator`](crate::MergeOperator) when the key is read.
+    pub fn merge(&self, key: Bytes, operand: Bytes) -> Result<()> {
+        self.merge_opt(key, operand, &WriteOptions::default())
+    }
+
+    pub fn merge_opt(&self, key: Bytes, operand: Bytes, options: &WriteOptions) -> Result<()> {
+        let mut batch  = Batch::write();
+        batch.merge(key, operand);
+        self.apply_batch_opt(batch, options)
+    }
+
+    /// Appends to the value of the key without reading it, creating the key if it does not exist.
+    /// This is a merge, and fails unless the database uses the default
+    /// [`ConcatOperator`](crate::ConcatOperator).
+    pub fn append(&self, key: Bytes, value: Bytes) -> Result<()> {
+        self.require_merge_operator(&ConcatOperator)?;
+        self.merge(key, value)
+    }
+
+    /// Adds `delta` to the counter stored under the key, treating a missing key as zero. This is a
+    /// merge, and fails unless the database was opened with
+    /// [`CounterOperator`](crate::CounterOperator) as its merge operator.
+    pub fn add(&self, key: Bytes, delta: i64) -> Result<()> {
+        self.require_merge_operator(&CounterOperator)?;
+        self.merge(key, CounterOperator::encode(delta).into())
+    }
+
+    /// Fails unless the configured merge operator has the same name as `operator`, so that
+    /// operands meant for one operator are not folded by another.
+    fn require_merge_operator(&self, operator: &dyn MergeOperator) -> Result<()> {
+        let configured = self.options.merge_operator.name();
+        if configured != operator.name() {
+            return Err(anyhow!(
+                "operation requires the {} merge operator, but the database uses {configured}",
+                operator.name()
+            ));
+        }
+        Ok(())
+    }
+
+    /// Deletes every key in `[start, end)`.
+    pub fn delete_range(&self, start: Bytes, end: Bytes) -> Result<()> {
+        self.delete_range_opt(start, end, &WriteOptions::default())
+    }
+
+    pub fn delete_range_opt(&self, start: Bytes, end: Bytes, options: &WriteOptions) -> Result<()> {
+        let mut batch  = Batch::write();
+        batch.delete_range(start, end);
+        self.apply_batch_opt(batch, options)
+    }
+
+    /// Probes the database for readiness: that the log accepts writes, the data directory is
+    /// reachable, and no background error has been recorded. This is cheap enough to back a
+    /// readiness endpoint.
+    pub fn health(&self) -> HealthStatus {
+        HealthStatus {
+            wal_writable: self.wal.lock().probe().is_ok(),
+            directory_accessible: match self.resources.acquire(Resource::OpenFiles, 1) {
+                Ok(_dir) => fs::read_dir(&self.path).is_ok(),
+                Err(_) => false,
+            },
+            background_error: self.background_error.lock().clone(),
+        }
     }
-}
\ No newline at end of file
+
+    /// Syncs the write-ahead log, making every write acknowledged so far durable, including those
+    /// made without [`WriteOptions::sync`].
+    pub fn sync(&self) -> Result<()> {
+        let mut wal = self.wal.lock();
+        if wal.unsynced_bytes() > 0 {
+            wal.sync()?;
+        }
+        Ok(())
+    }
+
+    /// Reads back every record of every write-ahead log in the directory, verifying its checksum
+    /// and that it decodes as a batch. Fails with a [`CorruptionError`] locating the first damaged
+    /// record. Writes wait until verification completes, since the live log is read up to its end.
+    pub fn verify_checksums(&self) -> Result<()> {
+        let mut wal = self.wal.lock();
+        wal.flush()?;
+        for id in list_wals(&self.path, &self.resources)? {
+            let log = wal_path(&self.path, id);
+            let _reader_file = self.resources.acquire(Resource::OpenFiles, 1)?;
+            let mut reader = WalReader::open(&log, true)?;
+            let mut offset = reader.offset();
+            while let Some(record) = reader.next_record()? {
+                if let Err(e) = Batch::decode(&record) {
+                    return Err(CorruptionError::new(&log, offset, format!("{e:#}")).into());
+                }
+                offset = reader.offset();
+            }
+        }
+        Ok(())
+    }
+
+    /// Returns an error describing the first failed check of [`DB::health`], if any.
+    pub fn ping(&self) -> Result<()> {
+        let status = self.health();
+        if let Some(e) = status.background_error {
+            return Err(anyhow!("background error: {e}"));
+        }
+        if !status.directory_accessible {
+            return Err(anyhow!("data directory {} is not accessible", self.path.display()));
+        }
+        if !status.wal_writable {
+            return Err(anyhow!("write-ahead log is not writable"));
+        }
+        Ok(())
+    }
+
+    /// Returns a snapshot of the database's internal state.
+    pub fn metrics(&self) -> Metrics {
+        let memtable = self.memtable.read().clone();
+        let wal = self.wal.lock();
+        Metrics {
+            wal: WalMetrics {
+                files: self.wal_files,
+                size: wal.size(),
+                unsynced_bytes: wal.unsynced_bytes(),
+                sync_latency: wal.sync_latency(),
+            },
+            memtable: MemTableMetrics {
+                count: 1,
+                size: memtable.size(),
+                entries: memtable.num_entries(),
+                tombstones: memtable.tombstones(),
+            },
+            commit_latency: self.pipeline.commit_latency(),
+            resources: self.resources.usage(),
+            seqnums: SeqNums {
+                logged: self.pipeline.logged_seq(),
+                visible: self.pipeline.visible_seq(),
+                durable: wal.synced_seq(),
+            },
+        }
+    }
+
+    /// Returns the files, mappings, and background threads currently held by this database.
+    pub fn resource_usage(&self) -> ResourceUsage {
+        self.resources.usage()
+    }
+}
+
+impl CommitEnv for DB {
+    fn write(&self, records: &[Vec<u8>], last_seq: KeyTimestamp, sync: bool) -> Result<()> {
+        let mut wal = self.wal.lock();
+        let result = records
+            .iter()
+            .try_for_each(|record| wal.append(record).map(|_| ()))
+            .and_then(|()| {
+                wal.set_last_seq(last_seq);
+                if sync {
+                    wal.sync()
+                } else {
+                    wal.flush()
+                }
+            });
+        if result.is_ok() && wal.unsynced_bytes() >= self.options.wal_bytes_per_sync {
+            self.wal_syncer.request();
+        }
+        if let Err(e) = &result {
+            // A failed append or sync leaves the tail of the log in an unknown state, so further
+            // writes cannot safely be appended after it.
+            self.options
+                .logger
+                .error(format_args!("wal write failed, rejecting further writes: {e:#}"));
+            self.background_error
+                .lock()
+                .get_or_insert_with(|| format!("{e:#}"));
+        }
+        result
+    }
+
+    fn apply(&self, batch: &Batch<{ BatchType::Write }>, seq: KeyTimestamp) -> Result<()> {
+        let memtable = self.memtable.read().clone();
+        apply_to(&memtable, batch, seq)
+    }
+}
+
+/// Inserts the entries of a batch into the memtable, numbering them consecutively from `seq` in
+/// the order they were encoded.
+fn apply_to(
+    memtable: &MemoryTable,
+    batch: &Batch<{ BatchType::Write }>,
+    seq: KeyTimestamp,
+) -> Result<()> {
+    for (i, (start, end)) in batch.range_deletes.iter().enumerate() {
+        let ts = seq + i as u64;
+        memtable.delete_range(
+            KeyBytes::from_bytes(start.clone(), KeyTrailer::new(ts, KeyKind::RangeDelete)),
+            end.clone(),
+        )?;
+    }
+
+    let seq = seq + batch.range_deletes.len() as u64;
+    for (i, (key, value)) in batch.items.iter().enumerate() {
+        let ts = seq + i as u64;
+        match (value, batch.expirations.get(key)) {
+            (Some(value), Some(expires_at)) => {
+                let mut expiring = Vec::with_capacity(size_of::<u64>() + value.len());
+                expiring.extend_from_slice(&expires_at.to_le_bytes());
+                expiring.extend_from_slice(value);
+                memtable.put(
+                    KeyBytes::from_bytes(key.clone(), KeyTrailer::new(ts, KeyKind::SetWithExpiry)),
+                    expiring.into(),
+                )?
+            }
+            (Some(value), None) => memtable.put(
+                KeyBytes::from_bytes(key.clone(), KeyTrailer::new(ts, KeyKind::Set)),
+                value.clone(),
+            )?,
+            (None, _) => {
+                let kind = match batch.archived.contains(key) {
+                    true => KeyKind::Archive,
+                    false => KeyKind::Delete,
+                };
+                memtable.delete(KeyBytes::from_bytes(key.clone(), KeyTrailer::new(ts, kind)))?
+            }
+        }
+    }
+
+    let seq = seq + batch.items.len() as u64;
+    for (i, (key, operand)) in batch.merges.iter().enumerate() {
+        let ts = seq + i as u64;
+        memtable.put(
+            KeyBytes::from_bytes(key.clone(), KeyTrailer::new(ts, KeyKind::Merge)),
+            operand.clone(),
+        )?;
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::SystemTime;
+
+    use super::*;
+    use crate::clock::ManualClock;
+    use crate::logger::NoopLogger;
+    use crate::reservation::RangeReservedError;
+    use crate::resource::ResourceLimitError;
+    use crate::wal::RECORD_HEADER_SIZE;
+    use crate::test_util::{count_allocated_bytes, count_allocations, tmpdir};
+
+    fn options() -> Options {
+        Options {
+            logger: Arc::new(NoopLogger),
+            ..Options::default()
+        }
+    }
+
+    #[test]
+    fn open_truncates_damaged_tail() {
+        let dir = tmpdir("db-damaged-tail");
+        {
+            let db = DB::open_with_options(&dir, options()).unwrap();
+            db.insert(Bytes::from("a"), Bytes::from("1")).unwrap();
+            db.insert(Bytes::from("b"), Bytes::from("2")).unwrap();
+            db.verify_checksums().unwrap();
+        }
+        let log = wal_path(&dir, 0);
+        let mut data = fs::read(&log).unwrap();
+        *data.last_mut().unwrap() ^= 0xff;
+        fs::write(&log, data).unwrap();
+
+        let paranoid = Options {
+            paranoid_checks: true,
+            ..options()
+        };
+        let e = DB::open_with_options(&dir, paranoid).err().unwrap();
+        assert!(e.downcast_ref::<CorruptionError>().is_some());
+
+        let db = DB::open_with_options(&dir, options()).unwrap();
+        assert_eq!(db.get("a").unwrap(), Some(Bytes::from("1")));
+        assert_eq!(db.get("b").unwrap(), None);
+        db.verify_checksums().unwrap();
+    }
+
+    #[test]
+    fn open_does_not_truncate_behind_damaged_length() {
+        let dir = tmpdir("db-damaged-length");
+        {
+            let db = DB::open_with_options(&dir, options()).unwrap();
+            db.insert(Bytes::from("a"), Bytes::from("1")).unwrap();
+            db.insert(Bytes::from("b"), Bytes::from("2")).unwrap();
+        }
+        // Make the first record claim to run past the end of the log.
+        let log = wal_path(&dir, 0);
+        let mut data = fs::read(&log).unwrap();
+        data[6] ^= 0x01;
+        fs::write(&log, &data).unwrap();
+
+        let e = DB::open_with_options(&dir, options()).err().unwrap();
+        assert_eq!(e.downcast_ref::<CorruptionError>().unwrap().offset, 0);
+        assert_eq!(fs::read(&log).unwrap(), data);
+    }
+
+    #[test]
+    fn verify_checksums_locates_damage() {
+        let dir = tmpdir("db-verify");
+        let db = DB::open_with_options(&dir, options()).unwrap();
+        db.insert(Bytes::from("a"), Bytes::from("1")).unwrap();
+        db.insert(Bytes::from("b"), Bytes::from("2")).unwrap();
+
+        let log = wal_path(&dir, 0);
+        let mut data = fs::read(&log).unwrap();
+        data[RECORD_HEADER_SIZE] ^= 0xff;
+        fs::write(&log, data).unwrap();
+
+        let e = db.verify_checksums().unwrap_err();
+        let e = e.downcast_ref::<CorruptionError>().unwrap();
+        assert_eq!((e.file.as_path(), e.offset), (log.as_path(), 0));
+    }
+
+    #[test]
+    fn reservation_holder_writes_reserved_range() {
+        let db = DB::open_with_options(tmpdir("db-reserved"), options()).unwrap();
+        let reservation = db.reserve_range(Bytes::from("b"), Bytes::from("d")).unwrap();
+        let other = db.reserve_range(Bytes::from("x"), Bytes::from("z")).unwrap();
+
+        let e = db.insert(Bytes::from("c"), Bytes::from("1")).unwrap_err();
+        assert!(e.is::<RangeReservedError>());
+
+        let mut batch = Batch::write();
+        batch.insert(Bytes::from("b"), Bytes::from("1"));
+        batch.delete_range(Bytes::from("b1"), Bytes::from("c"));
+        db.apply_batch_reserved(&reservation, batch, &WriteOptions::NO_SYNC).unwrap();
+        assert_eq!(db.get("b").unwrap(), Some(Bytes::from("1")));
+
+        // The reservation only covers its own range.
+        let mut batch = Batch::write();
+        batch.insert(Bytes::from("y"), Bytes::from("1"));
+        let e = db.apply_batch_reserved(&reservation, batch, &WriteOptions::NO_SYNC).unwrap_err();
+        assert!(e.is::<RangeReservedError>());
+
+        drop(other);
+        drop(reservation);
+        db.insert(Bytes::from("c"), Bytes::from("2")).unwrap();
+    }
+
+    #[test]
+    fn overlong_ttl_fails() {
+        let db = DB::open_with_options(tmpdir("db-ttl"), options()).unwrap();
+        let e = db.insert_with_ttl(Bytes::from("a"), Bytes::from("1"), Duration::MAX);
+        assert!(e.is_err());
+        assert_eq!(db.get("a").unwrap(), None);
+    }
+
+    #[test]
+    fn read_batch_reads_every_key() {
+        let db = DB::open_with_options(tmpdir("db-read-batch"), options()).unwrap();
+        db.insert(Bytes::from("a"), Bytes::from("1")).unwrap();
+
+        let mut batch = Batch::read();
+        batch.get("a");
+        batch.get("b");
+        let values = db.read_batch(batch).unwrap();
+        assert_eq!(values.get(b"a".as_slice()), Some(&Some(Bytes::from("1"))));
+        assert_eq!(values.get(b"b".as_slice()), Some(&None));
+
+        assert!(db.apply_batch(Batch::read()).is_err());
+    }
+
+    #[test]
+    fn later_writes_in_a_batch_win() {
+        type Build = fn(&mut Batch<{ BatchType::Write }>);
+        let cases: [(&str, Option<&str>, Build); 4] = [
+            ("insert, remove", None, |b| {
+                b.insert("k", "1");
+                b.remove("k");
+            }),
+            ("insert, merge, insert", Some("3"), |b| {
+                b.insert("k", "1");
+                b.merge("k", "2");
+                b.insert("k", "3");
+            }),
+            ("remove, merge", Some("1"), |b| {
+                b.remove("k");
+                b.merge("k", "1");
+            }),
+            ("delete range, insert", Some("1"), |b| {
+                b.delete_range("a", "z");
+                b.insert("k", "1");
+            }),
+        ];
+
+        for (name, expected, build) in cases {
+            let dir = tmpdir("db-batch-repeated-key");
+            let expected = expected.map(Bytes::from);
+            {
+                let db = DB::open_with_options(&dir, options()).unwrap();
+                db.insert(Bytes::from("k"), Bytes::from("old")).unwrap();
+                let mut batch = Batch::write();
+                build(&mut batch);
+                db.apply_batch(batch).unwrap();
+                assert_eq!(db.get("k").unwrap(), expected, "{name}");
+            }
+            // Replaying the log applies the batch's entries in the same order.
+            let db = DB::open_with_options(&dir, options()).unwrap();
+            assert_eq!(db.get("k").unwrap(), expected, "{name} after reopening");
+        }
+    }
+
+    #[test]
+    fn append_and_add_require_their_merge_operator() {
+        let db = DB::open_with_options(tmpdir("db-append"), options()).unwrap();
+        db.append(Bytes::from("a"), Bytes::from("1")).unwrap();
+        db.append(Bytes::from("a"), Bytes::from("2")).unwrap();
+        assert_eq!(db.get("a").unwrap(), Some(Bytes::from("12")));
+        assert!(db.add(Bytes::from("a"), 1).is_err());
+        assert_eq!(db.get("a").unwrap(), Some(Bytes::from("12")));
+
+        let options = Options {
+            merge_operator: Arc::new(CounterOperator),
+            ..options()
+        };
+        let db = DB::open_with_options(tmpdir("db-add"), options).unwrap();
+        db.add(Bytes::from("a"), 2).unwrap();
+        db.add(Bytes::from("a"), -5).unwrap();
+        let value = db.get("a").unwrap().unwrap();
+        assert_eq!(CounterOperator::decode(&value).unwrap(), -3);
+        assert!(db.append(Bytes::from("a"), Bytes::from("1")).is_err());
+        assert_eq!(db.get("a").unwrap(), Some(value));
+    }
+
+    #[test]
+    fn log_reads_count_against_open_files() {
+        let dir = tmpdir("db-open-files");
+        let options = |max_open_files| Options {
+            max_open_files: Some(max_open_files),
+            ..options()
+        };
+        {
+            let db = DB::open_with_options(&dir, options(1)).unwrap();
+            db.insert(Bytes::from("a"), Bytes::from("1")).unwrap();
+        }
+
+        // Replay holds one file at a time, and releases it before the log is reopened for writing.
+        let db = DB::open_with_options(&dir, options(1)).unwrap();
+        assert_eq!(db.get("a").unwrap(), Some(Bytes::from("1")));
+        let e = db.verify_checksums().unwrap_err();
+        assert!(e.downcast_ref::<ResourceLimitError>().is_some(), "{e:#}");
+        assert!(!db.health().directory_accessible);
+        drop(db);
+
+        let db = DB::open_with_options(&dir, options(2)).unwrap();
+        db.verify_checksums().unwrap();
+        assert!(db.health().directory_accessible);
+        assert_eq!(db.resource_usage().open_files, 1);
+    }
+
+    #[test]
+    fn metrics_record_commit_and_sync_latency() {
+        let db = DB::open_with_options(tmpdir("db-latency"), options()).unwrap();
+        db.insert(Bytes::from("a"), Bytes::from("1")).unwrap();
+        db.insert(Bytes::from("b"), Bytes::from("2")).unwrap();
+
+        let metrics = db.metrics();
+        assert_eq!(metrics.commit_latency.count, 2);
+        assert_eq!(metrics.wal.sync_latency.count, 2);
+    }
+
+    #[test]
+    fn metrics_count_wal_files() {
+        let dir = tmpdir("db-wal-files");
+        let db = DB::open_with_options(&dir, options()).unwrap();
+        assert_eq!(db.metrics().wal.files, 1);
+        drop(db);
+
+        // The newest log becomes the live one, and the older one is still counted.
+        fs::write(wal_path(&dir, 1), b"").unwrap();
+        let db = DB::open_with_options(&dir, options()).unwrap();
+        assert_eq!(db.metrics().wal.files, 2);
+    }
+
+    #[test]
+    fn health_probes_the_log_file() {
+        let dir = tmpdir("db-health");
+        let db = DB::open_with_options(&dir, options()).unwrap();
+        db.insert(Bytes::from("a"), Bytes::from("1")).unwrap();
+        assert!(db.health().is_healthy());
+
+        OpenOptions::new().write(true).open(wal_path(&dir, 0)).unwrap().set_len(0).unwrap();
+        assert!(!db.health().wal_writable);
+        assert!(db.ping().is_err());
+
+        fs::remove_file(wal_path(&dir, 0)).unwrap();
+        assert!(!db.health().wal_writable);
+    }
+
+    #[test]
+    fn get_does_not_allocate() {
+        let dir = tmpdir("db-get-allocations");
+        let db = DB::open_with_options(&dir, options()).unwrap();
+        db.insert(Bytes::from("key"), Bytes::from("value")).unwrap();
+        db.remove(Bytes::from("removed")).unwrap();
+
+        for key in ["key", "removed", "missing"] {
+            assert_eq!(count_allocations(|| db.get(key).unwrap()), 0, "reading {key:?}");
+        }
+    }
+
+    #[test]
+    fn insert_allocations() {
+        let dir = tmpdir("db-insert-allocations");
+        let db = DB::open_with_options(&dir, options()).unwrap();
+        // Let the commit queue reach its working capacity first.
+        db.insert(Bytes::from_static(b"warm"), Bytes::from_static(b"up")).unwrap();
+
+        // At most one allocation for each structure an insert passes through: the batch's map
+        // node, the commit request, the commit group, its records, the encoded record, and the
+        // memtable's skiplist node.
+        const MAX_ALLOCATIONS: usize = 6;
+        for _ in 0..3 {
+            let (key, value) = (Bytes::from_static(b"key"), Bytes::from_static(b"value"));
+            let allocations = count_allocations(|| db.insert(key, value).unwrap());
+            assert!(allocations <= MAX_ALLOCATIONS, "{allocations} allocations");
+        }
+
+        // The value is shared with the memtable rather than copied, so the encoded record is the
+        // only copy made of it.
+        let value = Bytes::from(vec![0; 64 << 10]);
+        let bytes = count_allocated_bytes(|| db.insert(Bytes::from("key"), value.clone()).unwrap());
+        assert!(bytes < 2 * value.len(), "{bytes} bytes allocated");
+    }
+
+    #[test]
+    fn export_keeps_ttl_under_merges() {
+        let clock = Arc::new(ManualClock::new(SystemTime::UNIX_EPOCH));
+        let options = || Options {
+            clock: clock.clone(),
+            ..options()
+        };
+        let db = DB::open_with_options(tmpdir("db-export-ttl"), options()).unwrap();
+        let ttl = Duration::from_secs(10);
+        db.insert_with_ttl(Bytes::from("expiring"), Bytes::from("a"), ttl).unwrap();
+        db.merge(Bytes::from("expiring"), Bytes::from("b")).unwrap();
+        db.insert_with_ttl(Bytes::from("expired"), Bytes::from("a"), Duration::ZERO).unwrap();
+        db.merge(Bytes::from("expired"), Bytes::from("b")).unwrap();
+        let mut export = Vec::new();
+        assert_eq!(db.export(&mut export).unwrap(), 2);
+
+        let imported = DB::open_with_options(tmpdir("db-import-ttl"), options()).unwrap();
+        assert_eq!(imported.import(export.as_slice()).unwrap(), 2);
+        assert_eq!(imported.get("expiring").unwrap(), Some(Bytes::from("ab")));
+        // The expired base leaves only its operand, which does not expire.
+        assert_eq!(imported.get("expired").unwrap(), Some(Bytes::from("b")));
+        clock.set(SystemTime::UNIX_EPOCH + ttl);
+        assert_eq!(imported.get("expiring").unwrap(), None);
+        assert_eq!(imported.get("expired").unwrap(), Some(Bytes::from("b")));
+    }
+}
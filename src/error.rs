@@ -0,0 +1,40 @@
+use std::fmt;
+use std::path::PathBuf;
+
+/// Returned when persisted data fails checksum verification or cannot be decoded. The file and
+/// offset identify where the damaged record or block begins so that it can be inspected or
+/// quarantined by hand.
+#[derive(Debug)]
+pub struct CorruptionError {
+    pub file: PathBuf,
+    pub offset: u64,
+    pub reason: String,
+}
+
+impl CorruptionError {
+    pub fn new<P, S>(file: P, offset: u64, reason: S) -> Self
+    where
+        P: Into<PathBuf>,
+        S: Into<String>,
+    {
+        CorruptionError {
+            file: file.into(),
+            offset,
+            reason: reason.into(),
+        }
+    }
+}
+
+impl fmt::Display for CorruptionError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "corruption in {} at offset {}: {}",
+            self.file.display(),
+            self.offset,
+            self.reason
+        )
+    }
+}
+
+impl std::error::Error for CorruptionError {}
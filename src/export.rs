@@ -0,0 +1,255 @@
+use std::io::{self, Read, Write};
+
+use anyhow::{anyhow, Result};
+use bytes::Bytes;
+
+use crate::key::KeyKind;
+
+/// Identifies an export stream and the version of its format.
+const MAGIC: &[u8; 8] = b"bldrexp1";
+
+/// Marks the trailer in place of an entry's kind.
+const TRAILER: u8 = u8::MAX;
+
+/// Writes an export stream: a magic number, the entries in key order, and a trailer holding the
+/// number of entries and a CRC32 checksum of everything before it. Each entry also ends with a
+/// checksum of its own, so that a reader can reject a damaged entry before acting on it rather
+/// than only once the whole stream has been read.
+///
+/// ```text
+/// +------------+---------+-----+---------+---------+
+/// | magic: [8] | entry 0 | ... | entry N | trailer |
+/// +------------+---------+-----+---------+---------+
+///
+/// +----------+--------------+-----------+----------------+-------------+----------+
+/// | kind: u8 | key_len: u32 | key: [u8] | value_len: u32 | value: [u8] | crc: u32 |
+/// +----------+--------------+-----------+----------------+-------------+----------+
+///
+/// +----------+------------+----------+
+/// | 0xff: u8 | count: u64 | crc: u32 |
+/// +----------+------------+----------+
+/// ```
+///
+/// Entries take the form [`Batch::add`](crate::Batch::add) accepts, so an import can replay them
+/// as written.
+pub struct ExportWriter<W> {
+    inner: W,
+    hasher: crc32fast::Hasher,
+    /// Checksums the entry being written.
+    entry: crc32fast::Hasher,
+    count: u64,
+}
+
+impl<W: Write> ExportWriter<W> {
+    pub fn new(inner: W) -> Result<Self> {
+        let mut writer = ExportWriter {
+            inner,
+            hasher: crc32fast::Hasher::new(),
+            entry: crc32fast::Hasher::new(),
+            count: 0,
+        };
+        writer.write(MAGIC)?;
+        Ok(writer)
+    }
+
+    pub fn add(&mut self, kind: KeyKind, key: &[u8], value: &[u8]) -> Result<()> {
+        self.entry = crc32fast::Hasher::new();
+        self.write(&[kind as u8])?;
+        self.write(&(key.len() as u32).to_le_bytes())?;
+        self.write(key)?;
+        self.write(&(value.len() as u32).to_le_bytes())?;
+        self.write(value)?;
+        let checksum = self.entry.clone().finalize();
+        self.write(&checksum.to_le_bytes())?;
+        self.count += 1;
+        Ok(())
+    }
+
+    /// Writes the trailer and returns the number of entries written.
+    pub fn finish(mut self) -> Result<u64> {
+        self.write(&[TRAILER])?;
+        self.write(&self.count.to_le_bytes())?;
+        let checksum = self.hasher.clone().finalize();
+        self.inner.write_all(&checksum.to_le_bytes())?;
+        self.inner.flush()?;
+        Ok(self.count)
+    }
+
+    fn write(&mut self, data: &[u8]) -> Result<()> {
+        self.hasher.update(data);
+        self.entry.update(data);
+        self.inner.write_all(data)?;
+        Ok(())
+    }
+}
+
+/// Reads the entries of a stream written by [`ExportWriter`]. Each entry is verified against its
+/// own checksum before it is returned, but the stream as a whole is only verified once the trailer
+/// is reached, so callers must not treat the entries as complete until
+/// [`ExportReader::next_entry`] has returned `None`.
+pub struct ExportReader<R> {
+    inner: R,
+    hasher: crc32fast::Hasher,
+    /// Checksums the entry being read.
+    entry: crc32fast::Hasher,
+    count: u64,
+}
+
+impl<R: Read> ExportReader<R> {
+    pub fn new(inner: R) -> Result<Self> {
+        let mut reader = ExportReader {
+            inner,
+            hasher: crc32fast::Hasher::new(),
+            entry: crc32fast::Hasher::new(),
+            count: 0,
+        };
+        let mut magic = [0; MAGIC.len()];
+        reader.read(&mut magic)?;
+        if &magic != MAGIC {
+            return Err(anyhow!("not an export stream"));
+        }
+        Ok(reader)
+    }
+
+    /// Returns the next entry, or `None` once the trailer has been read and verified.
+    pub fn next_entry(&mut self) -> Result<Option<(KeyKind, Bytes, Bytes)>> {
+        self.entry = crc32fast::Hasher::new();
+        let mut kind = [0; 1];
+        self.read(&mut kind)?;
+        if kind[0] == TRAILER {
+            let mut count = [0; 8];
+            self.read(&mut count)?;
+            let expected = self.hasher.clone().finalize();
+            let mut checksum = [0; 4];
+            self.inner.read_exact(&mut checksum).map_err(truncated)?;
+            if u32::from_le_bytes(checksum) != expected {
+                return Err(anyhow!("export stream failed checksum verification"));
+            }
+            if u64::from_le_bytes(count) != self.count {
+                return Err(anyhow!("export stream trailer does not match its entries"));
+            }
+            return Ok(None);
+        }
+
+        let key = self.read_bytes()?;
+        let value = self.read_bytes()?;
+        let expected = self.entry.clone().finalize();
+        let mut checksum = [0; 4];
+        self.read(&mut checksum)?;
+        if u32::from_le_bytes(checksum) != expected {
+            return Err(anyhow!("export stream entry {} failed checksum verification", self.count));
+        }
+        let kind = KeyKind::try_from(kind[0]).map_err(|e| anyhow!(e))?;
+        self.count += 1;
+        Ok(Some((kind, key, value)))
+    }
+
+    fn read_bytes(&mut self) -> Result<Bytes> {
+        let mut len = [0; 4];
+        self.read(&mut len)?;
+        let len = u32::from_le_bytes(len) as usize;
+        // The length is not trusted until the entry's checksum has been verified, so the buffer
+        // grows as bytes arrive rather than being sized up front.
+        let mut data = Vec::new();
+        (&mut self.inner).take(len as u64).read_to_end(&mut data)?;
+        if data.len() < len {
+            return Err(anyhow!("export stream is truncated"));
+        }
+        self.update(&data);
+        Ok(data.into())
+    }
+
+    fn read(&mut self, buf: &mut [u8]) -> Result<()> {
+        self.inner.read_exact(buf).map_err(truncated)?;
+        self.update(buf);
+        Ok(())
+    }
+
+    fn update(&mut self, data: &[u8]) {
+        self.hasher.update(data);
+        self.entry.update(data);
+    }
+}
+
+fn truncated(e: io::Error) -> anyhow::Error {
+    match e.kind() {
+        io::ErrorKind::UnexpectedEof => anyhow!("export stream is truncated"),
+        _ => e.into(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_util::count_allocated_bytes;
+
+    const ENTRIES: [(KeyKind, &[u8], &[u8]); 3] = [
+        (KeyKind::Set, b"a", b"first"),
+        (KeyKind::SetWithExpiry, b"b", b"\x01\0\0\0\0\0\0\0second"),
+        (KeyKind::Set, b"c", b""),
+    ];
+
+    fn stream() -> Vec<u8> {
+        let mut data = Vec::new();
+        let mut export = ExportWriter::new(&mut data).unwrap();
+        for (kind, key, value) in ENTRIES {
+            export.add(kind, key, value).unwrap();
+        }
+        assert_eq!(export.finish().unwrap(), ENTRIES.len() as u64);
+        data
+    }
+
+    /// Reads entries until the stream ends or fails, returning those read and the outcome.
+    fn read_all(data: &[u8]) -> (Vec<(KeyKind, Bytes, Bytes)>, Result<()>) {
+        let mut entries = Vec::new();
+        let mut reader = match ExportReader::new(data) {
+            Ok(reader) => reader,
+            Err(e) => return (entries, Err(e)),
+        };
+        loop {
+            match reader.next_entry() {
+                Ok(Some(entry)) => entries.push(entry),
+                Ok(None) => return (entries, Ok(())),
+                Err(e) => return (entries, Err(e)),
+            }
+        }
+    }
+
+    fn expected() -> Vec<(KeyKind, Bytes, Bytes)> {
+        ENTRIES
+            .iter()
+            .map(|(kind, key, value)| (*kind, Bytes::from(*key), Bytes::from(*value)))
+            .collect()
+    }
+
+    #[test]
+    fn round_trips() {
+        let (entries, result) = read_all(&stream());
+        result.unwrap();
+        assert_eq!(entries, expected());
+    }
+
+    #[test]
+    fn damaged_entry_is_never_returned() {
+        let data = stream();
+        for i in MAGIC.len()..data.len() {
+            for flip in [0x01, 0x80] {
+                let mut damaged = data.clone();
+                damaged[i] ^= flip;
+                let (entries, result) = read_all(&damaged);
+                assert!(result.is_err(), "damage at {i} went undetected");
+                assert_eq!(entries, expected()[..entries.len()], "damage at {i} was returned");
+            }
+        }
+    }
+
+    #[test]
+    fn declared_length_is_not_trusted() {
+        let mut data = stream();
+        // Claim the first key is 4 GiB long.
+        let len = MAGIC.len() + 1;
+        data[len..len + 4].copy_from_slice(&u32::MAX.to_le_bytes());
+        let bytes = count_allocated_bytes(|| assert!(read_all(&data).1.is_err()));
+        assert!(bytes < 64 << 10, "allocated {bytes} bytes");
+    }
+}
@@ -0,0 +1,101 @@
+//! Assertion layers for internal iterators, compiled in with the `invariants` feature. Without
+//! the feature, [`check`] returns the iterator unchanged and costs nothing.
+
+#[cfg(feature = "invariants")]
+use anyhow::Result;
+
+use crate::iterator::TraitIterator;
+use crate::key::KeySlice;
+
+#[cfg(feature = "invariants")]
+pub type Checked<I> = InvariantIterator<I>;
+#[cfg(not(feature = "invariants"))]
+pub type Checked<I> = I;
+
+/// Wraps `iter` in an [`InvariantIterator`] when the `invariants` feature is enabled.
+#[cfg(feature = "invariants")]
+pub fn check<I>(iter: I) -> Checked<I>
+where
+    I: 'static + for<'a> TraitIterator<KeyType<'a> = KeySlice<'a>>,
+{
+    InvariantIterator::new(iter)
+}
+
+#[cfg(not(feature = "invariants"))]
+pub fn check<I>(iter: I) -> Checked<I>
+where
+    I: 'static + for<'a> TraitIterator<KeyType<'a> = KeySlice<'a>>,
+{
+    iter
+}
+
+#[cfg(feature = "invariants")]
+use crate::key::KeyVec;
+
+/// Panics as soon as the wrapped iterator breaks its contract: keys must strictly increase in
+/// (user key, timestamp) order, and the key and value may only be read while the iterator is
+/// valid.
+#[cfg(feature = "invariants")]
+pub struct InvariantIterator<I> {
+    iter: I,
+    prev: Option<KeyVec>,
+}
+
+#[cfg(feature = "invariants")]
+impl<I> InvariantIterator<I>
+where
+    I: 'static + for<'a> TraitIterator<KeyType<'a> = KeySlice<'a>>,
+{
+    pub fn new(iter: I) -> Self {
+        let mut checked = InvariantIterator { iter, prev: None };
+        checked.check_order();
+        checked
+    }
+
+    fn check_order(&mut self) {
+        if !self.iter.is_valid() {
+            return;
+        }
+        let key = self.iter.key();
+        if let Some(prev) = &self.prev {
+            assert!(
+                prev.as_key_slice() < key,
+                "iterator moved backwards or repeated a key: {:?}@{} followed by {:?}@{}",
+                prev.key_ref(),
+                prev.timestamp(),
+                key.key_ref(),
+                key.timestamp(),
+            );
+        }
+        self.prev = Some(key.to_key_vec());
+    }
+}
+
+#[cfg(feature = "invariants")]
+impl<I> TraitIterator for InvariantIterator<I>
+where
+    I: 'static + for<'a> TraitIterator<KeyType<'a> = KeySlice<'a>>,
+{
+    type KeyType<'a> = KeySlice<'a>;
+
+    fn is_valid(&self) -> bool {
+        self.iter.is_valid()
+    }
+
+    fn value(&self) -> &[u8] {
+        assert!(self.iter.is_valid(), "value read from an exhausted iterator");
+        self.iter.value()
+    }
+
+    fn key(&self) -> KeySlice<'_> {
+        assert!(self.iter.is_valid(), "key read from an exhausted iterator");
+        self.iter.key()
+    }
+
+    fn next(&mut self) -> Result<()> {
+        assert!(self.iter.is_valid(), "next called on an exhausted iterator");
+        self.iter.next()?;
+        self.check_order();
+        Ok(())
+    }
+}
@@ -3,6 +3,10 @@ pub trait TraitIterator {
     where
         Self: 'a;
 
+    /// Returns whether the iterator is positioned at an entry. The key and value may only be
+    /// read while it is.
+    fn is_valid(&self) -> bool;
+
     /// Get the current value.
     fn value(&self) -> &[u8];
 
@@ -1,12 +1,23 @@
 use bytes::Bytes;
+use std::borrow::Borrow;
 use std::cmp::Ordering;
 use std::fmt::Debug;
 
+/// The kind of write an entry records. Values are stored as written, except that deletions and
+/// archives have no value and range deletions store the exclusive end of the range.
 #[repr(u8)]
-#[derive(Copy, Clone)]
+#[derive(Copy, Clone, Debug, Eq, PartialEq)]
 pub enum KeyKind {
     Delete = 0,
     Set = 1,
+    RangeDelete = 2,
+    Merge = 3,
+    /// A value that expires. The value is prefixed with its expiration time in milliseconds
+    /// since the Unix epoch as a little-endian u64.
+    SetWithExpiry = 4,
+    /// Hides the key from normal reads while leaving the versions beneath it readable with
+    /// [`ReadOptions::include_archived`](crate::ReadOptions::include_archived). Has no value.
+    Archive = 5,
 }
 
 impl TryFrom<u8> for KeyKind {
@@ -16,6 +27,10 @@ impl TryFrom<u8> for KeyKind {
         match value {
             0 => Ok(KeyKind::Delete),
             1 => Ok(KeyKind::Set),
+            2 => Ok(KeyKind::RangeDelete),
+            3 => Ok(KeyKind::Merge),
+            4 => Ok(KeyKind::SetWithExpiry),
+            5 => Ok(KeyKind::Archive),
             _ => Err("Invalid key kind"),
         }
     }
@@ -37,13 +52,28 @@ impl KeyTrailer {
         KeyTrailer(ts << 8 | kind as u64)
     }
 
-    fn kind(&self) -> KeyKind {
+    pub fn kind(&self) -> KeyKind {
         KeyKind::try_from((self.0 & 0xff) as u8).unwrap()
     }
 
-    fn timestamp(&self) -> KeyTimestamp {
+    pub fn timestamp(&self) -> KeyTimestamp {
         self.0 >> 8
     }
+
+    /// Returns the packed representation written to disk.
+    pub fn to_raw(&self) -> u64 {
+        self.0
+    }
+}
+
+impl TryFrom<u64> for KeyTrailer {
+    type Error = &'static str;
+
+    /// Decodes a trailer read back from disk, rejecting unknown key kinds.
+    fn try_from(value: u64) -> Result<Self, Self::Error> {
+        KeyKind::try_from((value & 0xff) as u8)?;
+        Ok(KeyTrailer(value))
+    }
 }
 
 impl Into<KeyKind> for KeyTrailer {
@@ -95,6 +125,10 @@ impl<T: AsRef<[u8]>> Key<T> {
 }
 
 impl Key<Vec<u8>> {
+    pub fn from_vec(key: Vec<u8>, trailer: KeyTrailer) -> Self {
+        Key(key, trailer)
+    }
+
     pub fn clear(&mut self) {
         self.0.clear()
     }
@@ -121,6 +155,10 @@ impl Key<Bytes> {
         Self(Bytes::new(), KeyTrailer::new(TIMESTAMP_RANGE_BEGIN, KeyKind::Delete))
     }
 
+    pub fn from_bytes(key: Bytes, trailer: KeyTrailer) -> Self {
+        Key(key, trailer)
+    }
+
     pub fn as_key_slice(&self) -> KeySlice {
         Key(&self.0, self.1)
     }
@@ -131,10 +169,18 @@ impl Key<Bytes> {
 }
 
 impl<'a> Key<&'a [u8]> {
+    pub fn from_slice(key: &'a [u8], trailer: KeyTrailer) -> Self {
+        Key(key, trailer)
+    }
+
     pub fn to_key_vec(self) -> KeyVec {
         Key(self.0.to_vec(), self.1)
     }
 
+    pub fn to_key_bytes(self) -> KeyBytes {
+        Key(Bytes::copy_from_slice(self.0), self.1)
+    }
+
     pub fn key_ref(self) -> &'a [u8] {
         self.0
     }
@@ -173,3 +219,47 @@ impl<T: AsRef<[u8]> + Ord> Ord for Key<T> {
         (self.0.as_ref(), self.1.timestamp() as u64).cmp(&(other.0.as_ref(), other.1.timestamp() as u64))
     }
 }
+
+/// A key borrowed as its user key and timestamp. Maps keyed by [`KeyBytes`] can be searched with
+/// `&dyn KeyView`, so a lookup can use a [`KeySlice`] without copying it into a [`KeyBytes`].
+/// Views order the same way as [`Key`].
+pub trait KeyView {
+    fn key_view(&self) -> &[u8];
+    fn timestamp_view(&self) -> KeyTimestamp;
+}
+
+impl<T: AsRef<[u8]>> KeyView for Key<T> {
+    fn key_view(&self) -> &[u8] {
+        self.0.as_ref()
+    }
+
+    fn timestamp_view(&self) -> KeyTimestamp {
+        self.timestamp()
+    }
+}
+
+impl<'a> Borrow<dyn KeyView + 'a> for KeyBytes {
+    fn borrow(&self) -> &(dyn KeyView + 'a) {
+        self
+    }
+}
+
+impl PartialEq for dyn KeyView + '_ {
+    fn eq(&self, other: &Self) -> bool {
+        self.cmp(other) == Ordering::Equal
+    }
+}
+
+impl Eq for dyn KeyView + '_ {}
+
+impl PartialOrd for dyn KeyView + '_ {
+    fn partial_cmp(&self, other: &Self) -> Option<Ordering> {
+        Some(self.cmp(other))
+    }
+}
+
+impl Ord for dyn KeyView + '_ {
+    fn cmp(&self, other: &Self) -> Ordering {
+        (self.key_view(), self.timestamp_view()).cmp(&(other.key_view(), other.timestamp_view()))
+    }
+}
@@ -1,15 +1,46 @@
 #![feature(adt_const_params)]
 #![allow(incomplete_features)]
 
+mod background;
 mod batch;
 mod block;
 mod bytes;
+mod clock;
+mod commit;
 mod compact;
 mod db;
 mod disk_table;
+mod error;
+mod export;
+mod invariants;
 mod iterator;
 mod key;
+mod lock;
+mod logger;
 mod manifest;
 mod mem_table;
+mod merge;
+mod metrics;
+mod options;
+mod range_tombstone;
+mod reservation;
+mod resource;
+#[cfg(test)]
+mod test_util;
 mod transaction;
 mod wal;
+
+pub use batch::{Batch, BatchType, BatchWriter};
+pub use clock::{Clock, ManualClock, SystemClock};
+pub use db::{HealthStatus, ValueReader, DB};
+pub use error::CorruptionError;
+pub use key::KeyKind;
+pub use lock::LockTimeoutError;
+pub use logger::{Logger, NoopLogger, StderrLogger};
+pub use mem_table::Tombstones;
+pub use merge::{ConcatOperator, CounterOperator, MergeOperator};
+pub use metrics::{LatencyHistogram, MemTableMetrics, Metrics, Prometheus, SeqNums, WalMetrics};
+pub use options::{Options, ReadOptions, WriteOptions};
+pub use reservation::{RangeReservation, RangeReservedError};
+pub use resource::{Resource, ResourceLimitError, ResourceUsage};
+pub use transaction::{Consistency, Transaction, TransactionConflictError};
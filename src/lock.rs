@@ -0,0 +1,101 @@
+use std::fmt;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::time::{Duration, Instant};
+
+use anyhow::Result;
+use bytes::Bytes;
+use parking_lot::{Condvar, Mutex};
+
+/// Returned when a transaction gives up waiting for a lock held by another transaction. Waiting
+/// is bounded so that transactions waiting on each other fail rather than deadlock.
+#[derive(Debug)]
+pub struct LockTimeoutError {
+    pub start: Bytes,
+    pub end: Bytes,
+}
+
+impl fmt::Display for LockTimeoutError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "timed out waiting for lock on [{:?}, {:?})",
+            self.start, self.end
+        )
+    }
+}
+
+impl std::error::Error for LockTimeoutError {}
+
+struct RangeLock {
+    start: Bytes,
+    end: Bytes,
+    owner: u64,
+}
+
+/// Exclusive locks over key ranges held by pessimistic transactions. A single key is locked as
+/// the range holding only that key. Locks are re-entrant for their owner and are all released
+/// together when the owning transaction ends.
+pub struct LockManager {
+    locks: Mutex<Vec<RangeLock>>,
+    released: Condvar,
+    next_owner: AtomicU64,
+    timeout: Duration,
+}
+
+impl LockManager {
+    pub fn new(timeout: Duration) -> Self {
+        LockManager {
+            locks: Mutex::new(Vec::new()),
+            released: Condvar::new(),
+            next_owner: AtomicU64::new(0),
+            timeout,
+        }
+    }
+
+    /// Returns a new owner id for a transaction to lock with.
+    pub fn new_owner(&self) -> u64 {
+        self.next_owner.fetch_add(1, Ordering::Relaxed)
+    }
+
+    /// Locks the key for `owner`.
+    pub fn lock_key(&self, owner: u64, key: &[u8]) -> Result<()> {
+        let mut end = Vec::with_capacity(key.len() + 1);
+        end.extend_from_slice(key);
+        end.push(0);
+        self.lock_range(owner, Bytes::copy_from_slice(key), end.into())
+    }
+
+    /// Locks `[start, end)` for `owner`, waiting for conflicting locks held by other owners to be
+    /// released. Fails with a [`LockTimeoutError`] if they are not released in time.
+    pub fn lock_range(&self, owner: u64, start: Bytes, end: Bytes) -> Result<()> {
+        let deadline = Instant::now() + self.timeout;
+        let mut locks = self.locks.lock();
+        loop {
+            let conflict = locks
+                .iter()
+                .any(|lock| lock.owner != owner && lock.start < end && start < lock.end);
+            if !conflict {
+                let held = locks.iter().any(|lock| {
+                    lock.owner == owner && lock.start <= start && end <= lock.end
+                });
+                if !held {
+                    locks.push(RangeLock { start, end, owner });
+                }
+                return Ok(());
+            }
+            if self.released.wait_until(&mut locks, deadline).timed_out() {
+                return Err(LockTimeoutError { start, end }.into());
+            }
+        }
+    }
+
+    /// Releases every lock held by `owner`.
+    pub fn unlock_all(&self, owner: u64) {
+        let mut locks = self.locks.lock();
+        let held = locks.len();
+        locks.retain(|lock| lock.owner != owner);
+        if locks.len() != held {
+            self.released.notify_all();
+        }
+    }
+}
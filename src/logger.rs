@@ -0,0 +1,38 @@
+use std::fmt;
+
+/// Receives messages about notable events inside the database, such as recovery when it is opened
+/// and failures in the background that leave it read-only. Implementations can forward them to
+/// whatever logging framework the embedding application uses.
+pub trait Logger: Send + Sync {
+    fn info(&self, args: fmt::Arguments<'_>);
+
+    fn error(&self, args: fmt::Arguments<'_>);
+}
+
+impl fmt::Debug for dyn Logger {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str("Logger")
+    }
+}
+
+/// A [`Logger`] that writes each message to standard error on its own line.
+pub struct StderrLogger;
+
+impl Logger for StderrLogger {
+    fn info(&self, args: fmt::Arguments<'_>) {
+        eprintln!("boulder: {args}");
+    }
+
+    fn error(&self, args: fmt::Arguments<'_>) {
+        eprintln!("boulder: error: {args}");
+    }
+}
+
+/// A [`Logger`] that discards every message.
+pub struct NoopLogger;
+
+impl Logger for NoopLogger {
+    fn info(&self, _args: fmt::Arguments<'_>) {}
+
+    fn error(&self, _args: fmt::Arguments<'_>) {}
+}
@@ -1,15 +1,50 @@
-use std::sync::atomic::AtomicUsize;
+use std::ops::Bound;
+use std::sync::atomic::{AtomicUsize, Ordering};
 use std::sync::Arc;
 
 use anyhow::Result;
-use bytes::Bytes;
+use bytes::{Buf, Bytes};
+use crossbeam_skiplist::map::Entry;
 use crossbeam_skiplist::SkipMap;
-use crate::key::{KeyBytes, KeySlice};
+use crate::iterator::TraitIterator;
+use crate::key::{
+    KeyBytes, KeyKind, KeySlice, KeyTimestamp, KeyTrailer, KeyView, TIMESTAMP_RANGE_END,
+};
+use crate::merge::MergeOperator;
+use crate::range_tombstone::RangeTombstones;
 
-struct MemoryTable {
+/// The outcome of looking a key up in a memtable.
+#[derive(Clone, Debug, Eq, PartialEq)]
+pub enum Lookup {
+    /// The newest visible version of the key is a value.
+    Value(Bytes),
+    /// The newest visible version of the key is a deletion, either of the key itself or of a
+    /// range covering it. Older versions in other tables are shadowed.
+    Deleted,
+    /// The memtable holds no visible version of the key.
+    Missing,
+}
+
+/// Counts of the deletions held by a memtable, split by kind so that dead space can be attributed
+/// to the writes that caused it.
+#[derive(Copy, Clone, Debug, Default, Eq, PartialEq)]
+pub struct Tombstones {
+    pub point: usize,
+    /// The size of the deleted keys.
+    pub point_bytes: usize,
+    pub range: usize,
+    /// The size of the start and end keys of the deleted ranges.
+    pub range_bytes: usize,
+}
+
+pub struct MemoryTable {
     id: usize,
     approximate_size: Arc<AtomicUsize>,
+    point_deletions: AtomicUsize,
+    point_deletion_bytes: AtomicUsize,
+    range_deletion_bytes: AtomicUsize,
     list: Arc<SkipMap<KeyBytes, Bytes>>,
+    range_deletions: Arc<RangeTombstones>,
 }
 
 impl MemoryTable {
@@ -17,23 +52,151 @@ impl MemoryTable {
         MemoryTable {
             id,
             approximate_size: Arc::new(AtomicUsize::new(0)),
+            point_deletions: AtomicUsize::new(0),
+            point_deletion_bytes: AtomicUsize::new(0),
+            range_deletion_bytes: AtomicUsize::new(0),
             list: Arc::new(SkipMap::new()),
+            range_deletions: Arc::new(RangeTombstones::new()),
+        }
+    }
+
+    /// Looks up the newest version of the key no newer than the key's timestamp, taking range
+    /// deletions at or below that timestamp into account. Merge operands above the newest value
+    /// or deletion are folded onto it with `merge_operator`. Values that expired at or before
+    /// `now`, in milliseconds since the Unix epoch, are treated as deletions. Archived keys are
+    /// treated as deleted unless `include_archived` is set, in which case the archive is skipped
+    /// over and the versions beneath it are read.
+    pub fn get(
+        &self,
+        key: KeySlice,
+        merge_operator: &dyn MergeOperator,
+        now: u64,
+        include_archived: bool,
+    ) -> Result<Lookup> {
+        let read_ts = key.timestamp();
+        let deleted_at = self.range_deletions.covering_ts(key.key_ref(), read_ts);
+
+        // Walk the versions of the key from newest to oldest, collecting merge operands until a
+        // value or deletion is found.
+        let mut operands = Vec::new();
+        let mut entry = self.list.upper_bound(Bound::Included(&key as &dyn KeyView));
+        let base = loop {
+            let Some(e) = entry.filter(|e| {
+                e.key().key_ref() == key.key_ref()
+                    && deleted_at.map_or(true, |deleted_at| e.key().timestamp() > deleted_at)
+            }) else {
+                break None;
+            };
+            match e.key().kind() {
+                KeyKind::Set => break Some(Lookup::Value(e.value().clone())),
+                KeyKind::SetWithExpiry => {
+                    let mut value = e.value().clone();
+                    let expires_at = value.get_u64_le();
+                    if expires_at <= now {
+                        break Some(Lookup::Deleted);
+                    }
+                    break Some(Lookup::Value(value));
+                }
+                KeyKind::Delete | KeyKind::RangeDelete => break Some(Lookup::Deleted),
+                KeyKind::Archive if !include_archived => break Some(Lookup::Deleted),
+                KeyKind::Archive => entry = e.prev(),
+                KeyKind::Merge => {
+                    operands.push(e.value().clone());
+                    entry = e.prev();
+                }
+            }
+        };
+        let base = base.unwrap_or(match deleted_at {
+            Some(_) => Lookup::Deleted,
+            None => Lookup::Missing,
+        });
+
+        if operands.is_empty() {
+            return Ok(base);
+        }
+        let existing = match &base {
+            Lookup::Value(value) => Some(value.as_ref()),
+            _ => None,
+        };
+        let operands: Vec<&[u8]> = operands.iter().rev().map(|operand| operand.as_ref()).collect();
+        let value = merge_operator.full_merge(key.key_ref(), existing, &operands)?;
+        Ok(Lookup::Value(value.into()))
+    }
+
+    /// Returns the expiration time, in milliseconds since the Unix epoch, of the version a read of
+    /// the key at its timestamp is based on, if that version is a value written with one. Merge
+    /// operands are looked through, since the value they are folded onto carries their expiry.
+    pub fn expires_at(&self, key: KeySlice) -> Option<u64> {
+        let deleted_at = self.range_deletions.covering_ts(key.key_ref(), key.timestamp());
+        let mut entry = self.list.upper_bound(Bound::Included(&key as &dyn KeyView));
+        while let Some(e) = entry.filter(|e| {
+            e.key().key_ref() == key.key_ref()
+                && deleted_at.map_or(true, |deleted_at| e.key().timestamp() > deleted_at)
+        }) {
+            match e.key().kind() {
+                KeyKind::Merge => entry = e.prev(),
+                KeyKind::SetWithExpiry => return Some(e.value().clone().get_u64_le()),
+                _ => return None,
+            }
+        }
+        None
+    }
+
+    /// Returns the timestamp of the newest write affecting the key, whether a version of the key
+    /// itself or a range deletion covering it.
+    pub fn newest_ts(&self, key: &[u8]) -> Option<KeyTimestamp> {
+        let upper = KeySlice::from_slice(key, KeyTrailer::new(TIMESTAMP_RANGE_END, KeyKind::Set));
+        let point = self
+            .list
+            .upper_bound(Bound::Included(&upper as &dyn KeyView))
+            .filter(|e| e.key().key_ref() == key)
+            .map(|e| e.key().timestamp());
+        point.max(self.range_deletions.covering_ts(key, TIMESTAMP_RANGE_END))
+    }
+
+    /// Returns the range deletions written to the memtable, which a flush carries over alongside
+    /// the point entries.
+    pub fn range_deletions(&self) -> Arc<RangeTombstones> {
+        self.range_deletions.clone()
+    }
+
+    /// Returns an unpositioned iterator over the point entries of the memtable. Range deletions
+    /// are not surfaced by the iterator.
+    pub fn iter(&self) -> MemTableIterator {
+        MemTableIterator {
+            list: self.list.clone(),
+            current: None,
+            prefix: None,
         }
     }
 
-    pub fn get(&self, key: KeySlice) -> Option<Bytes> {
-        self.list
-            .get(Bytes::from_static())
-            .and_then(|e| Some(e.value().to_owned()))
+    /// Inserts a version of a key. The key and value are stored as given rather than copied, so
+    /// the only allocation is the skiplist node.
+    pub fn put(&self, key: KeyBytes, value: Bytes) -> Result<()> {
+        self.approximate_size
+            .fetch_add(key.raw_len() + value.len(), std::sync::atomic::Ordering::Relaxed);
+        self.list.insert(key, value);
+        Ok(())
     }
 
-    pub fn put(&self, key: KeySlice, value: &[u8]) -> Result<()> {
-        self.list.insert(key.into(), value.into());
+    pub fn delete(&self, key: KeyBytes) -> Result<()> {
+        self.approximate_size
+            .fetch_add(key.raw_len(), std::sync::atomic::Ordering::Relaxed);
+        if matches!(key.kind(), KeyKind::Delete) {
+            self.point_deletions.fetch_add(1, Ordering::Relaxed);
+            self.point_deletion_bytes.fetch_add(key.raw_len(), Ordering::Relaxed);
+        }
+        self.list.insert(key, Bytes::new());
         Ok(())
     }
 
-    pub fn delete(&self, key: KeySlice) -> Result<()> {
-        self.list.insert(key.into(), Bytes::new());
+    /// Deletes every key in `[start, end)` written before the start key's timestamp.
+    pub fn delete_range(&self, start: KeyBytes, end: Bytes) -> Result<()> {
+        self.approximate_size
+            .fetch_add(start.raw_len() + end.len(), std::sync::atomic::Ordering::Relaxed);
+        self.range_deletion_bytes.fetch_add(start.raw_len() + end.len(), Ordering::Relaxed);
+        let seq = start.timestamp();
+        self.range_deletions.insert(start.into_inner(), end, seq);
         Ok(())
     }
 
@@ -47,13 +210,247 @@ impl MemoryTable {
             .load(std::sync::atomic::Ordering::Relaxed)
     }
 
+    /// Returns the number of point entries, counting every version of every key.
+    pub fn num_entries(&self) -> usize {
+        self.list.len()
+    }
+
+    /// Returns the number and size of the point and range deletions written to the memtable.
+    /// Archives hide keys rather than delete them, and are not counted.
+    pub fn tombstones(&self) -> Tombstones {
+        Tombstones {
+            point: self.point_deletions.load(Ordering::Relaxed),
+            point_bytes: self.point_deletion_bytes.load(Ordering::Relaxed),
+            range: self.range_deletions.len(),
+            range_bytes: self.range_deletion_bytes.load(Ordering::Relaxed),
+        }
+    }
+
     pub fn is_empty(&self) -> bool {
-        self.list.is_empty()
+        self.list.is_empty() && self.range_deletions.is_empty()
     }
 }
 
-impl Drop for MemoryTable {
-    fn drop(&mut self) {
-        unimplemented!()
+/// Iterates over the point entries of a memtable in key order, with the versions of a key ordered
+/// from oldest to newest. Every positioning method descends the skiplist directly rather than
+/// walking it from the front. The iterator shares ownership of the skiplist, so it can outlive the
+/// borrow of the memtable it came from.
+pub struct MemTableIterator {
+    list: Arc<SkipMap<KeyBytes, Bytes>>,
+    current: Option<(KeyBytes, Bytes)>,
+    /// Set by [`MemTableIterator::seek_prefix_ge`]. The iterator is exhausted once it moves past
+    /// the keys starting with the prefix.
+    prefix: Option<Vec<u8>>,
+}
+
+impl MemTableIterator {
+    /// Positions the iterator at the first entry.
+    pub fn first(&mut self) {
+        self.prefix = None;
+        self.current = visible(self.list.front(), None);
+    }
+
+    /// Positions the iterator at the last entry.
+    pub fn last(&mut self) {
+        self.prefix = None;
+        self.current = visible(self.list.back(), None);
+    }
+
+    /// Positions the iterator at the first entry at or after `key`.
+    pub fn seek_ge(&mut self, key: KeySlice) {
+        self.prefix = None;
+        let entry = self.list.lower_bound(Bound::Included(&key as &dyn KeyView));
+        self.current = visible(entry, None);
+    }
+
+    /// Positions the iterator at the last entry before `key`.
+    pub fn seek_lt(&mut self, key: KeySlice) {
+        self.prefix = None;
+        let entry = self.list.upper_bound(Bound::Excluded(&key as &dyn KeyView));
+        self.current = visible(entry, None);
+    }
+
+    /// Positions the iterator at the first entry at or after `key`, and limits it to keys starting
+    /// with `prefix`. `key` must itself start with `prefix`.
+    pub fn seek_prefix_ge(&mut self, prefix: &[u8], key: KeySlice) {
+        debug_assert!(key.key_ref().starts_with(prefix));
+        self.prefix = Some(prefix.to_vec());
+        let entry = self.list.lower_bound(Bound::Included(&key as &dyn KeyView));
+        self.current = visible(entry, self.prefix.as_deref());
+    }
+
+    /// Moves to the previous entry.
+    pub fn prev(&mut self) {
+        let Some((key, _)) = &self.current else {
+            return;
+        };
+        let entry = self.list.upper_bound(Bound::Excluded(key));
+        self.current = visible(entry, self.prefix.as_deref());
+    }
+}
+
+/// Copies out the entry the iterator lands on, unless it falls outside the iterator's prefix.
+fn visible(
+    entry: Option<Entry<'_, KeyBytes, Bytes>>,
+    prefix: Option<&[u8]>,
+) -> Option<(KeyBytes, Bytes)> {
+    entry
+        .filter(|e| prefix.map_or(true, |prefix| e.key().key_ref().starts_with(prefix)))
+        .map(|e| (e.key().clone(), e.value().clone()))
+}
+
+impl TraitIterator for MemTableIterator {
+    type KeyType<'a> = KeySlice<'a>;
+
+    fn is_valid(&self) -> bool {
+        self.current.is_some()
+    }
+
+    fn value(&self) -> &[u8] {
+        &self.current.as_ref().unwrap().1
+    }
+
+    fn key(&self) -> KeySlice<'_> {
+        self.current.as_ref().unwrap().0.as_key_slice()
+    }
+
+    fn next(&mut self) -> Result<()> {
+        let Some((key, _)) = &self.current else {
+            return Ok(());
+        };
+        let entry = self.list.lower_bound(Bound::Excluded(key));
+        self.current = visible(entry, self.prefix.as_deref());
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::BTreeMap;
+
+    use super::*;
+    use crate::merge::ConcatOperator;
+    use crate::test_util::count_allocations;
+
+    type Model = BTreeMap<(Vec<u8>, KeyTimestamp), Vec<u8>>;
+
+    /// Returns the first model entry in `range` that starts with `prefix`, as the iterator should.
+    fn model_entry<'a>(
+        mut range: impl Iterator<Item = (&'a (Vec<u8>, KeyTimestamp), &'a Vec<u8>)>,
+        prefix: Option<&[u8]>,
+    ) -> Option<(Vec<u8>, KeyTimestamp)> {
+        range
+            .next()
+            .filter(|((key, _), _)| prefix.map_or(true, |prefix| key.starts_with(prefix)))
+            .map(|(key, _)| key.clone())
+    }
+
+    #[test]
+    fn put_and_get_allocations() {
+        let table = MemoryTable::new(0);
+        let key = Bytes::from_static(b"key");
+        let value = Bytes::from_static(b"value");
+        // The first write from a thread registers it with the skiplist's garbage collector.
+        let warm_up = KeyBytes::from_bytes(Bytes::new(), KeyTrailer::new(0, KeyKind::Set));
+        table.put(warm_up, Bytes::new()).unwrap();
+
+        // The skiplist node is the only allocation.
+        let put = KeyBytes::from_bytes(key.clone(), KeyTrailer::new(1, KeyKind::Set));
+        assert_eq!(count_allocations(|| table.put(put, value.clone()).unwrap()), 1);
+
+        let get = KeySlice::from_slice(&key, KeyTrailer::new(1, KeyKind::Set));
+        let lookup = || table.get(get, &ConcatOperator, 0, false).unwrap();
+        assert_eq!(count_allocations(lookup), 0);
+        assert_eq!(lookup(), Lookup::Value(value));
+    }
+
+    /// Drives a memtable iterator and a sorted model through the same random mix of inserts and
+    /// positioning calls, checking after every step that both are on the same entry.
+    #[test]
+    fn iterator_matches_sorted_model() {
+        let table = MemoryTable::new(0);
+        let mut model = Model::new();
+        let mut iter = table.iter();
+        let mut current: Option<(Vec<u8>, KeyTimestamp)> = None;
+        let mut prefix: Option<Vec<u8>> = None;
+
+        let mut state = 0x9e37_79b9_7f4a_7c15u64;
+        let mut random = move || {
+            state ^= state << 13;
+            state ^= state >> 7;
+            state ^= state << 17;
+            state
+        };
+        let random_key = |random: &mut dyn FnMut() -> u64| {
+            let len = random() % 4;
+            (0..len).map(|_| b"abc"[random() as usize % 3]).collect::<Vec<u8>>()
+        };
+
+        for step in 0..20_000 {
+            let key = random_key(&mut random);
+            let ts = random() % 8;
+            let seek = (key.clone(), ts);
+            let target = KeySlice::from_slice(&key, KeyTrailer::new(ts, KeyKind::Set));
+            match random() % 8 {
+                0 => {
+                    let value = random().to_le_bytes().to_vec();
+                    let trailer = KeyTrailer::new(ts, KeyKind::Set);
+                    let bytes = KeyBytes::from_bytes(Bytes::from(key.clone()), trailer);
+                    table.put(bytes, Bytes::from(value.clone())).unwrap();
+                    model.insert(seek, value);
+                    // The iterator stays on its entry, which may now have been overwritten.
+                    continue;
+                }
+                1 => {
+                    iter.first();
+                    prefix = None;
+                    current = model_entry(model.iter(), None);
+                }
+                2 => {
+                    iter.last();
+                    prefix = None;
+                    current = model_entry(model.iter().rev(), None);
+                }
+                3 => {
+                    iter.seek_ge(target);
+                    prefix = None;
+                    current = model_entry(model.range(seek..), None);
+                }
+                4 => {
+                    iter.seek_lt(target);
+                    prefix = None;
+                    current = model_entry(model.range(..seek).rev(), None);
+                }
+                5 => {
+                    let len = random() as usize % (key.len() + 1);
+                    iter.seek_prefix_ge(&key[..len], target);
+                    prefix = Some(key[..len].to_vec());
+                    current = model_entry(model.range(seek..), prefix.as_deref());
+                }
+                6 => {
+                    iter.next().unwrap();
+                    if let Some(at) = current.take() {
+                        let range = (Bound::Excluded(at), Bound::Unbounded);
+                        current = model_entry(model.range(range), prefix.as_deref());
+                    }
+                }
+                _ => {
+                    iter.prev();
+                    if let Some(at) = current.take() {
+                        current = model_entry(model.range(..at).rev(), prefix.as_deref());
+                    }
+                }
+            }
+
+            match &current {
+                Some(at) => {
+                    assert!(iter.is_valid(), "step {step}: expected {at:?}");
+                    let key = iter.key();
+                    assert_eq!((key.key_ref(), key.timestamp()), (&at.0[..], at.1), "step {step}");
+                    assert_eq!(iter.value(), &model[at][..], "step {step}");
+                }
+                None => assert!(!iter.is_valid(), "step {step}: expected the end"),
+            }
+        }
     }
 }
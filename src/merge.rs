@@ -0,0 +1,95 @@
+use std::fmt;
+
+use anyhow::{anyhow, Result};
+
+use crate::bytes::{get_varint, put_varint};
+
+/// Combines merge operands written with [`Batch::merge`](crate::Batch::merge) into a value. A
+/// merge lets a writer describe a change to a value without reading it first, and the operator
+/// folds the changes together when the key is read.
+pub trait MergeOperator: Send + Sync {
+    /// The name of the operator, used to tell operators apart. The operator a database's operands
+    /// were written for is not recorded, so opening the database with a different operator folds
+    /// the existing operands with that one instead.
+    fn name(&self) -> &str;
+
+    /// Applies `operands`, oldest first, to the existing value of the key, which is `None` if
+    /// the key had no value before the first operand.
+    fn full_merge(
+        &self,
+        key: &[u8],
+        existing: Option<&[u8]>,
+        operands: &[&[u8]],
+    ) -> Result<Vec<u8>>;
+}
+
+impl fmt::Debug for dyn MergeOperator {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(self.name())
+    }
+}
+
+/// The default merge operator, which appends each operand to the end of the value.
+pub struct ConcatOperator;
+
+impl MergeOperator for ConcatOperator {
+    fn name(&self) -> &str {
+        "boulder.concat"
+    }
+
+    fn full_merge(
+        &self,
+        _key: &[u8],
+        existing: Option<&[u8]>,
+        operands: &[&[u8]],
+    ) -> Result<Vec<u8>> {
+        let existing = existing.unwrap_or_default();
+        let len = operands.iter().fold(existing.len(), |len, operand| len + operand.len());
+        let mut value = Vec::with_capacity(len);
+        value.extend_from_slice(existing);
+        for operand in operands {
+            value.extend_from_slice(operand);
+        }
+        Ok(value)
+    }
+}
+
+/// A merge operator for 64-bit signed counters. Operands and values are zigzag-encoded varints;
+/// each operand is a delta added to the counter, and a key with no value starts at zero. Use
+/// [`CounterOperator::encode`] and [`CounterOperator::decode`] to convert to and from the stored
+/// form, or [`DB::add`](crate::DB::add) to apply a delta directly. Additions wrap on overflow.
+pub struct CounterOperator;
+
+impl CounterOperator {
+    pub fn encode(value: i64) -> Vec<u8> {
+        let mut buf = Vec::with_capacity(crate::bytes::MAX_VARINT_LEN);
+        put_varint(&mut buf, value);
+        buf
+    }
+
+    pub fn decode(buf: &[u8]) -> Result<i64> {
+        match get_varint(buf) {
+            Some((value, len)) if len == buf.len() => Ok(value),
+            _ => Err(anyhow!("malformed counter value")),
+        }
+    }
+}
+
+impl MergeOperator for CounterOperator {
+    fn name(&self) -> &str {
+        "boulder.counter"
+    }
+
+    fn full_merge(
+        &self,
+        _key: &[u8],
+        existing: Option<&[u8]>,
+        operands: &[&[u8]],
+    ) -> Result<Vec<u8>> {
+        let mut counter = existing.map_or(Ok(0), CounterOperator::decode)?;
+        for operand in operands {
+            counter = counter.wrapping_add(CounterOperator::decode(operand)?);
+        }
+        Ok(CounterOperator::encode(counter))
+    }
+}
@@ -0,0 +1,381 @@
+use std::fmt;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::time::Duration;
+
+use crate::key::KeyTimestamp;
+use crate::mem_table::Tombstones;
+use crate::resource::ResourceUsage;
+
+/// The upper bounds, in microseconds, of the buckets latencies are counted in. Latencies above
+/// the last bound are only counted in the total.
+const LATENCY_BUCKETS_MICROS: [u64; 16] = [
+    10, 25, 50, 100, 250, 500, 1_000, 2_500, 5_000, 10_000, 25_000, 50_000, 100_000, 250_000,
+    500_000, 1_000_000,
+];
+
+/// Counts latencies into the buckets of [`LATENCY_BUCKETS_MICROS`]. Recording is lock-free.
+pub(crate) struct Histogram {
+    buckets: [AtomicU64; LATENCY_BUCKETS_MICROS.len()],
+    count: AtomicU64,
+    sum_nanos: AtomicU64,
+}
+
+impl Histogram {
+    pub fn new() -> Self {
+        Histogram {
+            buckets: Default::default(),
+            count: AtomicU64::new(0),
+            sum_nanos: AtomicU64::new(0),
+        }
+    }
+
+    pub fn record(&self, latency: Duration) {
+        let micros = latency.as_micros();
+        let bucket = LATENCY_BUCKETS_MICROS.partition_point(|bound| (*bound as u128) < micros);
+        if let Some(bucket) = self.buckets.get(bucket) {
+            bucket.fetch_add(1, Ordering::Relaxed);
+        }
+        self.count.fetch_add(1, Ordering::Relaxed);
+        let nanos = latency.as_nanos().min(u64::MAX as u128) as u64;
+        self.sum_nanos.fetch_add(nanos, Ordering::Relaxed);
+    }
+
+    pub fn snapshot(&self) -> LatencyHistogram {
+        LatencyHistogram {
+            buckets: std::array::from_fn(|i| self.buckets[i].load(Ordering::Relaxed)),
+            count: self.count.load(Ordering::Relaxed),
+            sum: Duration::from_nanos(self.sum_nanos.load(Ordering::Relaxed)),
+        }
+    }
+}
+
+/// A point-in-time copy of a latency histogram.
+#[derive(Copy, Clone, Debug, Default, Eq, PartialEq)]
+pub struct LatencyHistogram {
+    /// The number of latencies in each bucket, not counting those in earlier buckets. See
+    /// [`LatencyHistogram::bounds`] for the bucket bounds.
+    pub buckets: [u64; LATENCY_BUCKETS_MICROS.len()],
+    pub count: u64,
+    pub sum: Duration,
+}
+
+impl LatencyHistogram {
+    /// Returns the inclusive upper bound of each bucket.
+    pub fn bounds() -> impl Iterator<Item = Duration> {
+        LATENCY_BUCKETS_MICROS.iter().map(|micros| Duration::from_micros(*micros))
+    }
+
+    /// Returns the mean latency, or zero if nothing has been recorded.
+    pub fn mean(&self) -> Duration {
+        match self.count {
+            0 => Duration::ZERO,
+            count => self.sum / count.min(u32::MAX as u64) as u32,
+        }
+    }
+}
+
+/// Metrics for the write-ahead log.
+#[derive(Copy, Clone, Debug, Default, Eq, PartialEq)]
+pub struct WalMetrics {
+    pub files: usize,
+    /// The size of the live log, including records not yet synced.
+    pub size: u64,
+    pub unsynced_bytes: u64,
+    /// How long each sync of the log took to reach stable storage.
+    pub sync_latency: LatencyHistogram,
+}
+
+/// Metrics for the memtables.
+#[derive(Copy, Clone, Debug, Default, Eq, PartialEq)]
+pub struct MemTableMetrics {
+    pub count: usize,
+    pub size: usize,
+    /// The number of point entries, counting every version of every key. Point deletions are
+    /// included.
+    pub entries: usize,
+    pub tombstones: Tombstones,
+}
+
+/// The progress of writes through the commit pipeline. Every entry at or below `visible` can be
+/// read, and every entry at or below `durable` survives a machine crash. Writes made without
+/// syncing become visible before they are durable.
+#[derive(Copy, Clone, Debug, Default, Eq, PartialEq)]
+pub struct SeqNums {
+    /// The last sequence number written to the write-ahead log.
+    pub logged: KeyTimestamp,
+    /// The last sequence number readers can observe.
+    pub visible: KeyTimestamp,
+    /// The last sequence number synced to stable storage.
+    pub durable: KeyTimestamp,
+}
+
+/// A point-in-time snapshot of a database's internal state, returned by
+/// [`DB::metrics`](crate::DB::metrics). Formatting it with `{}` renders a table meant for logs and
+/// debugging sessions.
+#[derive(Copy, Clone, Debug, Default, Eq, PartialEq)]
+pub struct Metrics {
+    pub wal: WalMetrics,
+    pub memtable: MemTableMetrics,
+    /// How long each commit took, from queueing its batch to it becoming visible.
+    pub commit_latency: LatencyHistogram,
+    pub resources: ResourceUsage,
+    pub seqnums: SeqNums,
+}
+
+/// Formats a byte count with a binary unit suffix.
+pub(crate) struct HumanBytes(pub u64);
+
+impl fmt::Display for HumanBytes {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        const UNITS: [&str; 5] = ["B", "KB", "MB", "GB", "TB"];
+        let mut value = self.0 as f64;
+        let mut unit = 0;
+        while value >= 1024.0 && unit < UNITS.len() - 1 {
+            value /= 1024.0;
+            unit += 1;
+        }
+        let formatted = if unit == 0 {
+            format!("{} {}", self.0, UNITS[0])
+        } else {
+            format!("{:.1} {}", value, UNITS[unit])
+        };
+        f.pad(&formatted)
+    }
+}
+
+impl fmt::Display for Metrics {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        writeln!(
+            f,
+            "{:_>11}_{:_>7}_{:_>10}_{:_>10}_{:_>12}_{:_>12}",
+            "component", "count", "size", "entries", "point-dels", "range-dels",
+        )?;
+        writeln!(
+            f,
+            "{:>11} {:>7} {:>10}",
+            "WAL",
+            self.wal.files,
+            HumanBytes(self.wal.size),
+        )?;
+        writeln!(
+            f,
+            "{:>11} {:>7} {:>10} {:>10} {:>12} {:>12}",
+            "memtable",
+            self.memtable.count,
+            HumanBytes(self.memtable.size as u64),
+            self.memtable.entries,
+            self.memtable.tombstones.point,
+            self.memtable.tombstones.range,
+        )?;
+        writeln!(
+            f,
+            "tombstones: {} point, {} range",
+            HumanBytes(self.memtable.tombstones.point_bytes as u64),
+            HumanBytes(self.memtable.tombstones.range_bytes as u64),
+        )?;
+        writeln!(f, "wal: {} unsynced", HumanBytes(self.wal.unsynced_bytes))?;
+        writeln!(
+            f,
+            "latency: {} commits, {:?} mean; {} wal syncs, {:?} mean",
+            self.commit_latency.count,
+            self.commit_latency.mean(),
+            self.wal.sync_latency.count,
+            self.wal.sync_latency.mean(),
+        )?;
+        writeln!(
+            f,
+            "resources: {} open files, {} mmapped, {} background threads",
+            self.resources.open_files,
+            HumanBytes(self.resources.mmap_bytes as u64),
+            self.resources.background_threads,
+        )?;
+        write!(
+            f,
+            "seqnums: {} logged, {} visible, {} durable",
+            self.seqnums.logged, self.seqnums.visible, self.seqnums.durable,
+        )
+    }
+}
+
+impl Metrics {
+    /// Returns the metrics in the Prometheus text exposition format, for serving from a scrape
+    /// endpoint. Take a fresh snapshot with [`DB::metrics`](crate::DB::metrics) on every scrape.
+    pub fn prometheus(&self) -> Prometheus<'_> {
+        Prometheus(self)
+    }
+}
+
+/// Formats [`Metrics`] in the Prometheus text exposition format. Returned by
+/// [`Metrics::prometheus`].
+pub struct Prometheus<'a>(&'a Metrics);
+
+impl Prometheus<'_> {
+    fn write(
+        f: &mut fmt::Formatter<'_>,
+        name: &str,
+        kind: &str,
+        help: &str,
+        value: impl fmt::Display,
+    ) -> fmt::Result {
+        writeln!(f, "# HELP boulder_{name} {help}")?;
+        writeln!(f, "# TYPE boulder_{name} {kind}")?;
+        writeln!(f, "boulder_{name} {value}")
+    }
+
+    fn write_histogram(
+        f: &mut fmt::Formatter<'_>,
+        name: &str,
+        help: &str,
+        histogram: &LatencyHistogram,
+    ) -> fmt::Result {
+        writeln!(f, "# HELP boulder_{name} {help}")?;
+        writeln!(f, "# TYPE boulder_{name} histogram")?;
+        let mut cumulative = 0;
+        for (bound, count) in LatencyHistogram::bounds().zip(histogram.buckets) {
+            cumulative += count;
+            let le = bound.as_secs_f64();
+            writeln!(f, "boulder_{name}_bucket{{le=\"{le}\"}} {cumulative}")?;
+        }
+        writeln!(f, "boulder_{name}_bucket{{le=\"+Inf\"}} {}", histogram.count)?;
+        writeln!(f, "boulder_{name}_sum {}", histogram.sum.as_secs_f64())?;
+        writeln!(f, "boulder_{name}_count {}", histogram.count)
+    }
+}
+
+impl fmt::Display for Prometheus<'_> {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let m = self.0;
+        Self::write(f, "wal_files", "gauge", "Live write-ahead log files.", m.wal.files)?;
+        Self::write(f, "wal_bytes", "gauge", "Size of the live write-ahead logs.", m.wal.size)?;
+        Self::write(
+            f,
+            "wal_unsynced_bytes",
+            "gauge",
+            "Bytes written to the write-ahead log but not yet synced.",
+            m.wal.unsynced_bytes,
+        )?;
+        Self::write_histogram(
+            f,
+            "wal_sync_seconds",
+            "Time taken to sync the write-ahead log to stable storage.",
+            &m.wal.sync_latency,
+        )?;
+        Self::write_histogram(
+            f,
+            "commit_seconds",
+            "Time taken to commit a batch, from queueing it to it becoming visible.",
+            &m.commit_latency,
+        )?;
+        Self::write(f, "memtables", "gauge", "Memtables held in memory.", m.memtable.count)?;
+        Self::write(
+            f,
+            "memtable_bytes",
+            "gauge",
+            "Approximate size of the memtables.",
+            m.memtable.size,
+        )?;
+        Self::write(
+            f,
+            "memtable_entries",
+            "gauge",
+            "Point entries in the memtables, counting every version of every key.",
+            m.memtable.entries,
+        )?;
+        Self::write(
+            f,
+            "memtable_point_deletions",
+            "gauge",
+            "Point deletions in the memtables.",
+            m.memtable.tombstones.point,
+        )?;
+        Self::write(
+            f,
+            "memtable_point_deletion_bytes",
+            "gauge",
+            "Size of the keys deleted by point deletions in the memtables.",
+            m.memtable.tombstones.point_bytes,
+        )?;
+        Self::write(
+            f,
+            "memtable_range_deletions",
+            "gauge",
+            "Range deletions in the memtables.",
+            m.memtable.tombstones.range,
+        )?;
+        Self::write(
+            f,
+            "memtable_range_deletion_bytes",
+            "gauge",
+            "Size of the bounds of range deletions in the memtables.",
+            m.memtable.tombstones.range_bytes,
+        )?;
+        Self::write(f, "open_files", "gauge", "Files held open.", m.resources.open_files)?;
+        Self::write(
+            f,
+            "mmap_bytes",
+            "gauge",
+            "Bytes held in memory mappings.",
+            m.resources.mmap_bytes,
+        )?;
+        Self::write(
+            f,
+            "background_threads",
+            "gauge",
+            "Background threads running.",
+            m.resources.background_threads,
+        )?;
+        Self::write(
+            f,
+            "logged_seqnum",
+            "gauge",
+            "Last sequence number written to the write-ahead log.",
+            m.seqnums.logged,
+        )?;
+        Self::write(
+            f,
+            "visible_seqnum",
+            "gauge",
+            "Last sequence number visible to readers.",
+            m.seqnums.visible,
+        )?;
+        Self::write(
+            f,
+            "durable_seqnum",
+            "gauge",
+            "Last sequence number synced to stable storage.",
+            m.seqnums.durable,
+        )
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn histogram_exports_cumulative_buckets() {
+        let histogram = Histogram::new();
+        histogram.record(Duration::from_micros(5));
+        histogram.record(Duration::from_micros(10));
+        histogram.record(Duration::from_micros(11));
+        histogram.record(Duration::from_secs(5));
+
+        let latency = histogram.snapshot();
+        assert_eq!(latency.buckets[..3], [2, 1, 0]);
+        assert_eq!(latency.count, 4);
+        assert_eq!(latency.sum, Duration::from_micros(5_000_026));
+
+        let metrics = Metrics {
+            commit_latency: latency,
+            ..Metrics::default()
+        };
+        let text = metrics.prometheus().to_string();
+        assert!(text.contains("# TYPE boulder_commit_seconds histogram\n"));
+        assert!(text.contains("boulder_commit_seconds_bucket{le=\"0.00001\"} 2\n"));
+        assert!(text.contains("boulder_commit_seconds_bucket{le=\"0.000025\"} 3\n"));
+        assert!(text.contains("boulder_commit_seconds_bucket{le=\"1\"} 3\n"));
+        assert!(text.contains("boulder_commit_seconds_bucket{le=\"+Inf\"} 4\n"));
+        assert!(text.contains("boulder_commit_seconds_count 4\n"));
+        assert!(text.contains("boulder_wal_sync_seconds_count 0\n"));
+    }
+}
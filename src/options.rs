@@ -0,0 +1,117 @@
+use std::sync::Arc;
+use std::time::Duration;
+
+use crate::clock::{Clock, SystemClock};
+use crate::logger::{Logger, NoopLogger};
+use crate::merge::{ConcatOperator, MergeOperator};
+
+/// Options used to configure a [`DB`](crate::db::DB) when it is opened.
+#[derive(Clone, Debug)]
+pub struct Options {
+    /// The maximum number of files the database may hold open at once. Embedders running many
+    /// instances in one process can use this to keep the process under its descriptor limit.
+    /// `None` leaves the count unbounded.
+    pub max_open_files: Option<usize>,
+
+    /// The maximum number of bytes the database may hold in memory mappings. `None` leaves the
+    /// mapped size unbounded.
+    pub max_mmap_bytes: Option<usize>,
+
+    /// The maximum number of background threads (flushes, compactions, syncing) the database may
+    /// run at once. `None` leaves the thread count unbounded.
+    pub max_background_threads: Option<usize>,
+
+    /// How often the write-ahead log is synced in the background when writes are made without
+    /// [`WriteOptions::sync`].
+    pub wal_sync_interval: Duration,
+
+    /// The number of unsynced bytes in the write-ahead log at which the background syncer is woken
+    /// early rather than waiting for `wal_sync_interval` to pass.
+    pub wal_bytes_per_sync: u64,
+
+    /// Whether opening the database fails when a write-ahead log ends in a partially written or
+    /// damaged record. By default such a record is treated as a write torn by a crash and
+    /// truncated. A damaged record followed by intact ones always fails the open, since truncating
+    /// it would drop acknowledged writes. See also
+    /// [`DB::verify_checksums`](crate::DB::verify_checksums).
+    pub paranoid_checks: bool,
+
+    /// Whether compactions into the bottom of the tree zero the sequence numbers of values every
+    /// snapshot can see. Disabling it keeps each value's original sequence number, which helps
+    /// when tracing where a value came from.
+    pub zero_seqnums: bool,
+
+    /// How long a synchronous transaction waits for a lock held by another transaction before
+    /// giving up. Transactions waiting on each other's locks time out rather than deadlock.
+    pub lock_timeout: Duration,
+
+    /// Whether a panic in a background thread aborts the process. By default the panic is caught
+    /// and recorded as a background error, after which the database rejects writes but stays
+    /// readable.
+    pub abort_on_background_panic: bool,
+
+    /// Folds merge operands into values when keys written with merges are read. Defaults to
+    /// [`ConcatOperator`], which is what [`DB::append`](crate::DB::append) relies on.
+    pub merge_operator: Arc<dyn MergeOperator>,
+
+    /// The clock used to decide whether keys written with a TTL have expired.
+    pub clock: Arc<dyn Clock>,
+
+    /// Where the database reports recovery progress and background failures. Defaults to
+    /// [`NoopLogger`], which discards them; pass
+    /// [`StderrLogger`](crate::StderrLogger) to see them on standard error.
+    pub logger: Arc<dyn Logger>,
+}
+
+impl Default for Options {
+    fn default() -> Self {
+        Options {
+            max_open_files: None,
+            max_mmap_bytes: None,
+            max_background_threads: None,
+            wal_sync_interval: Duration::from_millis(100),
+            wal_bytes_per_sync: 512 << 10,
+            paranoid_checks: false,
+            zero_seqnums: true,
+            lock_timeout: Duration::from_secs(1),
+            abort_on_background_panic: false,
+            merge_operator: Arc::new(ConcatOperator),
+            clock: Arc::new(SystemClock),
+            logger: Arc::new(NoopLogger),
+        }
+    }
+}
+
+/// Options that apply to a single read.
+#[derive(Copy, Clone, Debug, Default)]
+pub struct ReadOptions {
+    /// Whether keys hidden with [`DB::archive`](crate::DB::archive) are read as though they had
+    /// not been archived.
+    pub include_archived: bool,
+}
+
+/// Options that apply to a single write.
+#[derive(Copy, Clone, Debug)]
+pub struct WriteOptions {
+    /// Whether the write waits for the write-ahead log to be synced to stable storage before it
+    /// is acknowledged. Without it, the write is durable against a process crash but may be lost
+    /// if the machine fails before the background syncer next runs.
+    pub sync: bool,
+
+    /// Identifies the caller making the write, so that commit groups are shared fairly between
+    /// callers: each caller's first waiting write joins a group before any caller's second, and a
+    /// caller issuing many large writes at once cannot hold the others back. Writes without a
+    /// caller are grouped in the order they arrive.
+    pub caller: Option<u64>,
+}
+
+impl WriteOptions {
+    pub const SYNC: WriteOptions = WriteOptions { sync: true, caller: None };
+    pub const NO_SYNC: WriteOptions = WriteOptions { sync: false, caller: None };
+}
+
+impl Default for WriteOptions {
+    fn default() -> Self {
+        WriteOptions::SYNC
+    }
+}
@@ -0,0 +1,152 @@
+use std::collections::BTreeMap;
+use std::ops::Bound;
+use std::sync::atomic::{AtomicUsize, Ordering};
+
+use bytes::Bytes;
+use parking_lot::RwLock;
+
+use crate::key::KeyTimestamp;
+
+/// The range deletions of a table, split into fragments that do not overlap. Each fragment
+/// records every deletion covering it, so finding the deletions covering a key is a single ordered
+/// lookup however many ranges have been deleted.
+///
+/// Deleting `[b, d)` and then `[a, c)` leaves three fragments:
+///
+/// ```text
+/// [a, b): 2
+/// [b, c): 2, 1
+/// [c, d): 1
+/// ```
+pub struct RangeTombstones {
+    /// Fragments keyed by their inclusive start.
+    fragments: RwLock<BTreeMap<Bytes, Fragment>>,
+    /// The number of deletions inserted, before fragmenting.
+    count: AtomicUsize,
+}
+
+struct Fragment {
+    /// The exclusive end of the fragment.
+    end: Bytes,
+    /// The sequence numbers of the deletions covering the fragment, newest first.
+    seqs: Vec<KeyTimestamp>,
+}
+
+impl RangeTombstones {
+    pub fn new() -> Self {
+        RangeTombstones {
+            fragments: RwLock::new(BTreeMap::new()),
+            count: AtomicUsize::new(0),
+        }
+    }
+
+    /// Deletes every key in `[start, end)` written before `seq`.
+    pub fn insert(&self, start: Bytes, end: Bytes, seq: KeyTimestamp) {
+        self.count.fetch_add(1, Ordering::Relaxed);
+        if start >= end {
+            return;
+        }
+
+        let mut fragments = self.fragments.write();
+        split(&mut fragments, &start);
+        split(&mut fragments, &end);
+
+        // Every fragment starting inside the range now also ends inside it. Add the deletion to
+        // those and cover the gaps between them with new fragments.
+        let mut gaps = Vec::new();
+        let mut covered = start.clone();
+        for (fragment_start, fragment) in fragments.range_mut(start..end.clone()) {
+            if covered < *fragment_start {
+                gaps.push((covered, fragment_start.clone()));
+            }
+            let i = fragment.seqs.partition_point(|s| *s > seq);
+            fragment.seqs.insert(i, seq);
+            covered = fragment.end.clone();
+        }
+        if covered < end {
+            gaps.push((covered, end));
+        }
+        for (start, end) in gaps {
+            fragments.insert(start, Fragment { end, seqs: vec![seq] });
+        }
+    }
+
+    /// Returns the sequence number of the newest deletion no newer than `read_ts` that covers the
+    /// key.
+    pub fn covering_ts(&self, key: &[u8], read_ts: KeyTimestamp) -> Option<KeyTimestamp> {
+        let fragments = self.fragments.read();
+        let (_, fragment) = fragments
+            .range::<[u8], _>((Bound::Unbounded, Bound::Included(key)))
+            .next_back()?;
+        if key >= fragment.end.as_ref() {
+            return None;
+        }
+        fragment.seqs.iter().copied().find(|seq| *seq <= read_ts)
+    }
+
+    /// Returns the number of deletions inserted.
+    pub fn len(&self) -> usize {
+        self.count.load(Ordering::Relaxed)
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.len() == 0
+    }
+}
+
+/// Splits the fragment straddling `at`, if any, so that a fragment starts there.
+fn split(fragments: &mut BTreeMap<Bytes, Fragment>, at: &Bytes) {
+    let Some((_, fragment)) = fragments.range_mut(..at.clone()).next_back() else {
+        return;
+    };
+    if *at >= fragment.end {
+        return;
+    }
+    let tail = Fragment {
+        end: std::mem::replace(&mut fragment.end, at.clone()),
+        seqs: fragment.seqs.clone(),
+    };
+    fragments.insert(at.clone(), tail);
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// Finds the covering deletion by checking every range, as the fragments should.
+    fn naive(ranges: &[(&str, &str, u64)], key: &str, read_ts: u64) -> Option<u64> {
+        ranges
+            .iter()
+            .filter(|(start, end, seq)| *start <= key && key < *end && *seq <= read_ts)
+            .map(|(_, _, seq)| *seq)
+            .max()
+    }
+
+    #[test]
+    fn matches_unfragmented_ranges() {
+        let ranges = [
+            ("b", "d", 1),
+            ("a", "c", 2),
+            ("c", "f", 4),
+            ("e", "g", 3),
+            ("b", "b", 5),
+            ("a", "h", 6),
+            ("d", "e", 7),
+        ];
+        let tombstones = RangeTombstones::new();
+        for (n, &(start, end, seq)) in ranges.iter().enumerate() {
+            tombstones.insert(Bytes::from(start), Bytes::from(end), seq);
+            let inserted = &ranges[..=n];
+            for key in ["", "a", "aa", "b", "c", "cc", "d", "e", "f", "g", "h", "i"] {
+                for read_ts in 0..=8 {
+                    assert_eq!(
+                        tombstones.covering_ts(key.as_bytes(), read_ts),
+                        naive(inserted, key, read_ts),
+                        "key {key:?} at {read_ts} after {inserted:?}",
+                    );
+                }
+            }
+        }
+        assert_eq!(tombstones.len(), ranges.len());
+    }
+}
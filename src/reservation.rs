@@ -0,0 +1,126 @@
+use std::collections::BTreeMap;
+use std::fmt;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Arc;
+
+use anyhow::Result;
+use bytes::Bytes;
+use parking_lot::{RwLock, RwLockReadGuard};
+
+use crate::batch::{Batch, BatchType};
+
+/// Returned when a write or a new reservation overlaps a key range reserved with
+/// [`DB::reserve_range`](crate::DB::reserve_range).
+#[derive(Debug)]
+pub struct RangeReservedError {
+    pub start: Bytes,
+    pub end: Bytes,
+}
+
+impl fmt::Display for RangeReservedError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "key range [{:?}, {:?}) is reserved", self.start, self.end)
+    }
+}
+
+impl std::error::Error for RangeReservedError {}
+
+/// Keeps new reservations from being granted while held.
+pub type ReservationsGuard<'a> = RwLockReadGuard<'a, BTreeMap<u64, (Bytes, Bytes)>>;
+
+/// The key ranges currently reserved in a database. Writes hold a read lock from the time they are
+/// checked against the reservations until they are committed, and new reservations take the write
+/// lock, so a reservation is only granted once every write that might overlap it has landed.
+pub struct Reservations {
+    ranges: RwLock<BTreeMap<u64, (Bytes, Bytes)>>,
+    next_id: AtomicU64,
+}
+
+impl Reservations {
+    pub fn new() -> Self {
+        Reservations {
+            ranges: RwLock::new(BTreeMap::new()),
+            next_id: AtomicU64::new(0),
+        }
+    }
+
+    /// Reserves `[start, end)`, failing with a [`RangeReservedError`] if it overlaps an existing
+    /// reservation.
+    pub fn reserve(self: &Arc<Self>, start: Bytes, end: Bytes) -> Result<RangeReservation> {
+        if start >= end {
+            return Err(anyhow::anyhow!("reserved range must not be empty"));
+        }
+        let mut ranges = self.ranges.write();
+        if let Some((s, e)) = ranges.values().find(|(s, e)| start < *e && *s < end) {
+            return Err(RangeReservedError {
+                start: s.clone(),
+                end: e.clone(),
+            }
+            .into());
+        }
+        let id = self.next_id.fetch_add(1, Ordering::Relaxed);
+        ranges.insert(id, (start.clone(), end.clone()));
+        Ok(RangeReservation {
+            reservations: self.clone(),
+            id,
+            start,
+            end,
+        })
+    }
+
+    /// Checks that the batch writes nothing inside a reserved range other than the one held by
+    /// `holder`, if any. The returned guard must be held until the batch is committed.
+    pub fn admit(
+        &self,
+        batch: &Batch<{ BatchType::Write }>,
+        holder: Option<&RangeReservation>,
+    ) -> Result<ReservationsGuard<'_>> {
+        if holder.is_some_and(|holder| !std::ptr::eq(Arc::as_ptr(&holder.reservations), self)) {
+            return Err(anyhow::anyhow!("reservation was made on a different database"));
+        }
+        let ranges = self.ranges.read();
+        for (id, (start, end)) in ranges.iter() {
+            if holder.is_some_and(|holder| holder.id == *id) {
+                continue;
+            }
+            let covers = |key: &Bytes| start <= key && key < end;
+            let conflict = batch.items.keys().any(covers)
+                || batch.merges.iter().any(|(key, _)| covers(key))
+                || batch.range_deletes.iter().any(|(s, e)| start < e && s < end);
+            if conflict {
+                return Err(RangeReservedError {
+                    start: start.clone(),
+                    end: end.clone(),
+                }
+                .into());
+            }
+        }
+        Ok(ranges)
+    }
+}
+
+/// A reservation of a key range made through [`DB::reserve_range`](crate::DB::reserve_range).
+/// Writes to the range fail with a [`RangeReservedError`] until it is dropped, except those its
+/// holder makes through [`DB::apply_batch_reserved`](crate::DB::apply_batch_reserved).
+pub struct RangeReservation {
+    reservations: Arc<Reservations>,
+    id: u64,
+    start: Bytes,
+    end: Bytes,
+}
+
+impl RangeReservation {
+    pub fn start(&self) -> &Bytes {
+        &self.start
+    }
+
+    pub fn end(&self) -> &Bytes {
+        &self.end
+    }
+}
+
+impl Drop for RangeReservation {
+    fn drop(&mut self) {
+        self.reservations.ranges.write().remove(&self.id);
+    }
+}
@@ -0,0 +1,157 @@
+use std::fmt;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::Arc;
+
+use anyhow::Result;
+
+use crate::options::Options;
+
+/// A finite resource owned by a database instance.
+#[derive(Copy, Clone, Debug, Eq, PartialEq)]
+pub enum Resource {
+    OpenFiles,
+    MmapBytes,
+    BackgroundThreads,
+}
+
+impl fmt::Display for Resource {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Resource::OpenFiles => f.write_str("open files"),
+            Resource::MmapBytes => f.write_str("mmapped bytes"),
+            Resource::BackgroundThreads => f.write_str("background threads"),
+        }
+    }
+}
+
+/// Returned when acquiring a resource would take a database over the limit set in its
+/// [`Options`].
+#[derive(Debug)]
+pub struct ResourceLimitError {
+    pub resource: Resource,
+    pub limit: usize,
+    pub in_use: usize,
+    pub requested: usize,
+}
+
+impl fmt::Display for ResourceLimitError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "{} limit of {} reached: {} in use, {} requested",
+            self.resource, self.limit, self.in_use, self.requested
+        )
+    }
+}
+
+impl std::error::Error for ResourceLimitError {}
+
+/// A point-in-time view of the resources held by a database.
+#[derive(Copy, Clone, Debug, Default, Eq, PartialEq)]
+pub struct ResourceUsage {
+    pub open_files: usize,
+    pub mmap_bytes: usize,
+    pub background_threads: usize,
+}
+
+struct Counter {
+    in_use: AtomicUsize,
+    limit: Option<usize>,
+}
+
+impl Counter {
+    fn new(limit: Option<usize>) -> Self {
+        Counter {
+            in_use: AtomicUsize::new(0),
+            limit,
+        }
+    }
+}
+
+/// Counts the files, mappings, and threads held by a single database against the hard caps in
+/// its [`Options`]. Every acquisition hands back a [`ResourceGuard`] that returns the resource
+/// when dropped, so the counts cannot drift from what is actually held.
+pub struct ResourceTracker {
+    open_files: Counter,
+    mmap_bytes: Counter,
+    background_threads: Counter,
+}
+
+impl ResourceTracker {
+    pub fn new(options: &Options) -> Self {
+        ResourceTracker {
+            open_files: Counter::new(options.max_open_files),
+            mmap_bytes: Counter::new(options.max_mmap_bytes),
+            background_threads: Counter::new(options.max_background_threads),
+        }
+    }
+
+    fn counter(&self, resource: Resource) -> &Counter {
+        match resource {
+            Resource::OpenFiles => &self.open_files,
+            Resource::MmapBytes => &self.mmap_bytes,
+            Resource::BackgroundThreads => &self.background_threads,
+        }
+    }
+
+    /// Reserves `amount` of a resource, failing with a [`ResourceLimitError`] if doing so would
+    /// exceed the configured limit.
+    pub fn acquire(self: &Arc<Self>, resource: Resource, amount: usize) -> Result<ResourceGuard> {
+        let counter = self.counter(resource);
+        counter
+            .in_use
+            .fetch_update(Ordering::AcqRel, Ordering::Acquire, |in_use| {
+                let total = in_use.checked_add(amount)?;
+                match counter.limit {
+                    Some(limit) if total > limit => None,
+                    _ => Some(total),
+                }
+            })
+            .map_err(|in_use| ResourceLimitError {
+                resource,
+                limit: counter.limit.unwrap_or(usize::MAX),
+                in_use,
+                requested: amount,
+            })?;
+
+        Ok(ResourceGuard {
+            tracker: self.clone(),
+            resource,
+            amount,
+        })
+    }
+
+    pub fn usage(&self) -> ResourceUsage {
+        ResourceUsage {
+            open_files: self.open_files.in_use.load(Ordering::Relaxed),
+            mmap_bytes: self.mmap_bytes.in_use.load(Ordering::Relaxed),
+            background_threads: self.background_threads.in_use.load(Ordering::Relaxed),
+        }
+    }
+}
+
+/// Holds a reservation made through [`ResourceTracker::acquire`] and releases it when dropped.
+pub struct ResourceGuard {
+    tracker: Arc<ResourceTracker>,
+    resource: Resource,
+    amount: usize,
+}
+
+impl ResourceGuard {
+    pub fn resource(&self) -> Resource {
+        self.resource
+    }
+
+    pub fn amount(&self) -> usize {
+        self.amount
+    }
+}
+
+impl Drop for ResourceGuard {
+    fn drop(&mut self) {
+        self.tracker
+            .counter(self.resource)
+            .in_use
+            .fetch_sub(self.amount, Ordering::AcqRel);
+    }
+}
@@ -0,0 +1,70 @@
+use std::alloc::{GlobalAlloc, Layout, System};
+use std::cell::Cell;
+use std::path::PathBuf;
+use std::sync::atomic::{AtomicUsize, Ordering};
+
+/// Returns an empty directory for a test to work in, unique to the process and the call.
+pub fn tmpdir(name: &str) -> PathBuf {
+    static NEXT: AtomicUsize = AtomicUsize::new(0);
+    let dir = std::env::temp_dir().join(format!(
+        "boulder-{name}-{}-{}",
+        std::process::id(),
+        NEXT.fetch_add(1, Ordering::Relaxed)
+    ));
+    let _ = std::fs::remove_dir_all(&dir);
+    std::fs::create_dir_all(&dir).unwrap();
+    dir
+}
+
+/// Wraps the system allocator to count the allocations made by each thread, so that a test can
+/// check a path does not allocate without other tests running alongside it getting in the way.
+struct CountingAllocator;
+
+thread_local! {
+    static ALLOCATIONS: Cell<usize> = const { Cell::new(0) };
+    static ALLOCATED_BYTES: Cell<usize> = const { Cell::new(0) };
+}
+
+#[global_allocator]
+static ALLOCATOR: CountingAllocator = CountingAllocator;
+
+unsafe impl GlobalAlloc for CountingAllocator {
+    unsafe fn alloc(&self, layout: Layout) -> *mut u8 {
+        record(layout.size());
+        System.alloc(layout)
+    }
+
+    unsafe fn alloc_zeroed(&self, layout: Layout) -> *mut u8 {
+        record(layout.size());
+        System.alloc_zeroed(layout)
+    }
+
+    unsafe fn realloc(&self, ptr: *mut u8, layout: Layout, new_size: usize) -> *mut u8 {
+        record(new_size);
+        System.realloc(ptr, layout, new_size)
+    }
+
+    unsafe fn dealloc(&self, ptr: *mut u8, layout: Layout) {
+        System.dealloc(ptr, layout)
+    }
+}
+
+fn record(size: usize) {
+    let _ = ALLOCATIONS.try_with(|count| count.set(count.get() + 1));
+    let _ = ALLOCATED_BYTES.try_with(|bytes| bytes.set(bytes.get() + size));
+}
+
+/// Returns the number of allocations `f` makes on the calling thread, counting reallocations.
+pub fn count_allocations<T>(f: impl FnOnce() -> T) -> usize {
+    let before = ALLOCATIONS.get();
+    std::hint::black_box(f());
+    ALLOCATIONS.get() - before
+}
+
+/// Returns the number of bytes `f` allocates on the calling thread, counting a reallocation as a
+/// fresh allocation of its new size.
+pub fn count_allocated_bytes<T>(f: impl FnOnce() -> T) -> usize {
+    let before = ALLOCATED_BYTES.get();
+    std::hint::black_box(f());
+    ALLOCATED_BYTES.get() - before
+}
@@ -1,31 +1,171 @@
-/// Transactions
-/// 
-/// Should be lazily executed, like async/await
-/// 
+use std::collections::BTreeSet;
+use std::fmt;
 
+use anyhow::Result;
+use bytes::Bytes;
+
+use crate::batch::{Batch, BatchType};
+use crate::db::DB;
+use crate::key::KeyTimestamp;
+use crate::options::WriteOptions;
+
+/// How a transaction keeps concurrent transactions from interfering with it.
 #[derive(Copy, Clone, Debug, Eq, PartialEq)]
 pub enum Consistency {
+    /// Reads are tracked and checked for newer writes when the transaction commits. Nothing is
+    /// locked, so a transaction that lost a race fails to commit and can be retried.
     Optimistic,
+    /// Every key is locked before it is read or written, and ranges are locked before they are
+    /// deleted, so commits never fail with a conflict. A transaction that cannot get a lock within
+    /// [`Options::lock_timeout`](crate::Options::lock_timeout) fails with a
+    /// [`LockTimeoutError`](crate::LockTimeoutError). Locks only coordinate transactions with
+    /// each other; writes made outside a transaction do not take them.
     Synchronous,
 }
 
-pub struct TransactionHandle {
-    
+/// Returned when a transaction fails to commit because a key it read was written after the
+/// transaction began.
+#[derive(Debug)]
+pub struct TransactionConflictError {
+    pub key: Bytes,
 }
 
-impl TransactionHandle {
-    pub fn execute(&self, consistency: Consistency) {
-        unimplemented!()
-    }
-    
-    pub fn default(&self) {
-        self.execute(Consistency::Optimistic)
+impl fmt::Display for TransactionConflictError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "transaction conflict on key {:?}", self.key)
     }
 }
 
-pub struct Transaction {
-    
+impl std::error::Error for TransactionConflictError {}
+
+/// A transaction buffers its writes in a batch, and its reads see its own writes. Nothing is
+/// written to the database until [`Transaction::commit`]. Dropping a transaction without
+/// committing discards its writes and releases its locks.
+///
+/// An optimistic transaction reads from a consistent view of the database taken when it began,
+/// and its commit fails with a [`TransactionConflictError`] if any key it read has been written
+/// since. A synchronous transaction reads the latest state of each key after locking it.
+pub struct Transaction<'a> {
+    db: &'a DB,
+    consistency: Consistency,
+    read_ts: KeyTimestamp,
+    /// The owner id the transaction holds locks under, if it is synchronous.
+    lock_owner: Option<u64>,
+    /// Keys read from the database rather than from the transaction's own writes.
+    reads: BTreeSet<Bytes>,
+    writes: Batch<{ BatchType::Write }>,
+}
+
+impl<'a> Transaction<'a> {
+    pub(crate) fn new(db: &'a DB, consistency: Consistency, read_ts: KeyTimestamp) -> Self {
+        Transaction {
+            db,
+            consistency,
+            read_ts,
+            lock_owner: match consistency {
+                Consistency::Optimistic => None,
+                Consistency::Synchronous => Some(db.locks().new_owner()),
+            },
+            reads: BTreeSet::new(),
+            writes: Batch::write(),
+        }
+    }
+
+    pub fn consistency(&self) -> Consistency {
+        self.consistency
+    }
+
+    /// Returns the value of the key with the transaction's own writes applied on top. An
+    /// optimistic transaction reads the key as of the start of the transaction, and a synchronous
+    /// one locks the key and reads its latest value.
+    pub fn get<K: AsRef<[u8]>>(&mut self, key: K) -> Result<Option<Bytes>> {
+        let key = key.as_ref();
+        let base = match self.writes.items.get(key) {
+            Some(value) => value.clone(),
+            None if self.writes.range_deletes.iter().any(|(s, e)| s <= key && key < e) => None,
+            None => match self.lock_owner {
+                Some(owner) => {
+                    self.db.locks().lock_key(owner, key)?;
+                    self.db.get_at(key, self.db.visible_seq(), false)?
+                }
+                None => {
+                    self.reads.insert(Bytes::copy_from_slice(key));
+                    self.db.get_at(key, self.read_ts, false)?
+                }
+            },
+        };
+
+        let operands: Vec<&[u8]> = self
+            .writes
+            .merges
+            .iter()
+            .filter(|(merged, _)| merged == key)
+            .map(|(_, operand)| operand.as_ref())
+            .collect();
+        if operands.is_empty() {
+            return Ok(base);
+        }
+        let merge_operator = &self.db.options().merge_operator;
+        let value = merge_operator.full_merge(key, base.as_deref(), &operands)?;
+        Ok(Some(value.into()))
+    }
+
+    pub fn insert(&mut self, key: Bytes, value: Bytes) -> Result<()> {
+        self.lock_key(&key)?;
+        self.writes.insert(key, value);
+        Ok(())
+    }
+
+    pub fn remove(&mut self, key: Bytes) -> Result<()> {
+        self.lock_key(&key)?;
+        self.writes.remove(key);
+        Ok(())
+    }
+
+    pub fn merge(&mut self, key: Bytes, operand: Bytes) -> Result<()> {
+        self.lock_key(&key)?;
+        self.writes.merge(key, operand);
+        Ok(())
+    }
+
+    /// Deletes every key in `[start, end)`.
+    pub fn delete_range(&mut self, start: Bytes, end: Bytes) -> Result<()> {
+        if let Some(owner) = self.lock_owner {
+            self.db.locks().lock_range(owner, start.clone(), end.clone())?;
+        }
+        self.writes.delete_range(start, end);
+        Ok(())
+    }
+
+    fn lock_key(&self, key: &[u8]) -> Result<()> {
+        match self.lock_owner {
+            Some(owner) => self.db.locks().lock_key(owner, key),
+            None => Ok(()),
+        }
+    }
+
+    pub fn commit(self) -> Result<()> {
+        self.commit_opt(&WriteOptions::default())
+    }
+
+    /// Writes the transaction's changes to the database. An optimistic transaction only commits
+    /// if none of the keys it read have been written since it began.
+    pub fn commit_opt(mut self, options: &WriteOptions) -> Result<()> {
+        let writes = std::mem::replace(&mut self.writes, Batch::write());
+        match self.consistency {
+            Consistency::Optimistic => {
+                self.db
+                    .commit_transaction(self.read_ts, &self.reads, writes, options)
+            }
+            Consistency::Synchronous => self.db.apply_batch_opt(writes, options),
+        }
+    }
 }
 
-impl Transaction {
-}
\ No newline at end of file
+impl Drop for Transaction<'_> {
+    fn drop(&mut self) {
+        if let Some(owner) = self.lock_owner {
+            self.db.locks().unlock_all(owner);
+        }
+    }
+}
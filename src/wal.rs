@@ -0,0 +1,506 @@
+use std::fs::{self, File, OpenOptions};
+use std::io::{BufReader, BufWriter, ErrorKind, Read, Write};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::thread::JoinHandle;
+use std::time::{Duration, Instant};
+
+use anyhow::Result;
+use parking_lot::{Condvar, Mutex};
+
+use crate::background;
+use crate::error::CorruptionError;
+use crate::key::KeyTimestamp;
+use crate::logger::Logger;
+use crate::metrics::{Histogram, LatencyHistogram};
+use crate::resource::ResourceGuard;
+
+/// Every record is prefixed with a header holding the CRC32 checksum of the record followed by the
+/// payload length. The checksum covers the length as well as the payload so that a damaged length
+/// cannot send the reader off into the middle of another record undetected.
+///
+/// ```text
+/// +----------+-------------+---------------+
+/// | crc: u32 | length: u32 | payload: [u8] |
+/// +----------+-------------+---------------+
+/// ```
+pub const RECORD_HEADER_SIZE: usize = 8;
+
+fn record_checksum(len: u32, payload: &[u8]) -> u32 {
+    let mut hasher = crc32fast::Hasher::new();
+    hasher.update(&len.to_le_bytes());
+    hasher.update(payload);
+    hasher.finalize()
+}
+
+/// Appends checksummed records to a write-ahead log file.
+pub struct WalWriter {
+    path: PathBuf,
+    file: BufWriter<File>,
+    offset: u64,
+    synced: u64,
+    /// The sequence number of the last entry appended to the log.
+    last_seq: KeyTimestamp,
+    /// The sequence number of the last entry known to be on stable storage.
+    synced_seq: KeyTimestamp,
+    sync_latency: Histogram,
+}
+
+impl WalWriter {
+    /// Opens the log at `path` for appending, creating it if necessary. `last_seq` is the sequence
+    /// number of the last entry already in the log, or in earlier logs.
+    pub fn create<P: AsRef<Path>>(path: P, last_seq: KeyTimestamp) -> Result<Self> {
+        let path = path.as_ref().to_path_buf();
+        let file = OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(&path)?;
+        let offset = file.metadata()?.len();
+        Ok(WalWriter {
+            path,
+            file: BufWriter::new(file),
+            offset,
+            synced: offset,
+            last_seq,
+            synced_seq: last_seq,
+            sync_latency: Histogram::new(),
+        })
+    }
+
+    /// Appends a record and returns the offset at which it begins. The record is buffered and
+    /// only reaches the file on the next [`WalWriter::flush`] or [`WalWriter::sync`].
+    pub fn append(&mut self, payload: &[u8]) -> Result<u64> {
+        let len = u32::try_from(payload.len())
+            .map_err(|_| anyhow::anyhow!("wal record of {} bytes is too large", payload.len()))?;
+        let offset = self.offset;
+        self.file.write_all(&record_checksum(len, payload).to_le_bytes())?;
+        self.file.write_all(&len.to_le_bytes())?;
+        self.file.write_all(payload)?;
+        self.offset += (RECORD_HEADER_SIZE + payload.len()) as u64;
+        Ok(offset)
+    }
+
+    /// Records that every entry up to `seq` has been appended, so that the next sync makes them
+    /// durable.
+    pub fn set_last_seq(&mut self, seq: KeyTimestamp) {
+        self.last_seq = seq;
+    }
+
+    /// Hands buffered records to the operating system without waiting for them to be durable.
+    pub fn flush(&mut self) -> Result<()> {
+        self.file.flush()?;
+        Ok(())
+    }
+
+    /// Flushes buffered records and waits for them to reach stable storage.
+    pub fn sync(&mut self) -> Result<()> {
+        let start = Instant::now();
+        self.file.flush()?;
+        self.file.get_ref().sync_data()?;
+        self.sync_latency.record(start.elapsed());
+        self.synced = self.offset;
+        self.synced_seq = self.last_seq;
+        Ok(())
+    }
+
+    /// Returns the number of bytes appended since the log was last synced.
+    pub fn unsynced_bytes(&self) -> u64 {
+        self.offset - self.synced
+    }
+
+    /// Checks that appends are still reaching the log: buffered records are handed to the
+    /// operating system, and both the open file and the file at the log's path hold every byte
+    /// appended. This catches a failing file as well as a log truncated, removed, or replaced
+    /// underneath the writer, without waiting for stable storage.
+    pub fn probe(&mut self) -> Result<()> {
+        self.file.flush()?;
+        for len in [self.file.get_ref().metadata()?.len(), fs::metadata(&self.path)?.len()] {
+            if len != self.offset {
+                return Err(anyhow::anyhow!(
+                    "{} holds {len} bytes, but {} were appended",
+                    self.path.display(),
+                    self.offset
+                ));
+            }
+        }
+        Ok(())
+    }
+
+    /// Returns the sequence number of the last entry known to be on stable storage.
+    pub fn synced_seq(&self) -> KeyTimestamp {
+        self.synced_seq
+    }
+
+    /// Returns how long each sync has taken.
+    pub fn sync_latency(&self) -> LatencyHistogram {
+        self.sync_latency.snapshot()
+    }
+
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+
+    /// Returns the size of the log including records that are still buffered.
+    pub fn size(&self) -> u64 {
+        self.offset
+    }
+}
+
+struct SyncerState {
+    stopped: bool,
+    requested: bool,
+}
+
+struct SyncerShared {
+    wal: Arc<Mutex<WalWriter>>,
+    state: Mutex<SyncerState>,
+    wake: Condvar,
+}
+
+/// Syncs a write-ahead log in the background on behalf of writes that did not wait for it
+/// themselves. The log is synced every `interval`, or sooner when a writer calls
+/// [`WalSyncer::request`] after letting too many unsynced bytes build up. The thread is stopped
+/// and joined when the syncer is dropped.
+pub struct WalSyncer {
+    shared: Arc<SyncerShared>,
+    handle: Option<JoinHandle<()>>,
+    _thread: ResourceGuard,
+}
+
+impl WalSyncer {
+    /// Starts the syncer thread. `on_error` is called with any error hit while syncing, or with
+    /// the panic if the thread panics, after which the syncer stops. See
+    /// [`background::spawn`](crate::background::spawn) for `abort_on_panic` and `logger`.
+    pub fn start<F>(
+        wal: Arc<Mutex<WalWriter>>,
+        interval: Duration,
+        thread: ResourceGuard,
+        abort_on_panic: bool,
+        logger: Arc<dyn Logger>,
+        on_error: F,
+    ) -> Result<Self>
+    where
+        F: Fn(anyhow::Error) + Send + 'static,
+    {
+        let shared = Arc::new(SyncerShared {
+            wal,
+            state: Mutex::new(SyncerState {
+                stopped: false,
+                requested: false,
+            }),
+            wake: Condvar::new(),
+        });
+
+        let handle = background::spawn(
+            "boulder-wal-sync",
+            abort_on_panic,
+            logger,
+            {
+                let shared = shared.clone();
+                move || loop {
+                    {
+                        let mut state = shared.state.lock();
+                        if !state.requested && !state.stopped {
+                            shared.wake.wait_for(&mut state, interval);
+                        }
+                        if state.stopped {
+                            return Ok(());
+                        }
+                        state.requested = false;
+                    }
+
+                    let mut wal = shared.wal.lock();
+                    if wal.unsynced_bytes() > 0 {
+                        wal.sync()?;
+                    }
+                }
+            },
+            on_error,
+        )?;
+
+        Ok(WalSyncer {
+            shared,
+            handle: Some(handle),
+            _thread: thread,
+        })
+    }
+
+    /// Wakes the syncer to sync the log now instead of at the end of its interval.
+    pub fn request(&self) {
+        self.shared.state.lock().requested = true;
+        self.shared.wake.notify_one();
+    }
+}
+
+impl Drop for WalSyncer {
+    fn drop(&mut self) {
+        self.shared.state.lock().stopped = true;
+        self.shared.wake.notify_one();
+        if let Some(handle) = self.handle.take() {
+            let _ = handle.join();
+        }
+    }
+}
+
+/// Reads back the records of a write-ahead log, verifying the checksum of each one.
+pub struct WalReader {
+    path: PathBuf,
+    file: BufReader<File>,
+    offset: u64,
+    len: u64,
+    paranoid: bool,
+}
+
+impl WalReader {
+    /// Opens the log at `path` for reading. A `paranoid` reader fails on a damaged or partially
+    /// written final record instead of treating it as a torn write.
+    pub fn open<P: AsRef<Path>>(path: P, paranoid: bool) -> Result<Self> {
+        let path = path.as_ref().to_path_buf();
+        let file = File::open(&path)?;
+        let len = file.metadata()?.len();
+        Ok(WalReader {
+            path,
+            file: BufReader::new(file),
+            offset: 0,
+            len,
+            paranoid,
+        })
+    }
+
+    /// Returns the next record, or `None` at the end of the log.
+    ///
+    /// A record torn by a crash was never acknowledged to a writer, so it ends the log unless the
+    /// reader is paranoid. A record is only taken to be torn when it is the last thing in the
+    /// log: a partial header, a record whose length runs past the end of the log with no intact
+    /// record anywhere after it, or a record whose checksum does not match followed by nothing but
+    /// zeros, like the tail some filesystems leave after a power loss. Anything else fails with a
+    /// [`CorruptionError`], so that damage cannot silently drop the acknowledged records after it.
+    pub fn next_record(&mut self) -> Result<Option<Vec<u8>>> {
+        if self.offset == self.len {
+            return Ok(None);
+        }
+        let mut header = [0u8; RECORD_HEADER_SIZE];
+        if !self.read_full(&mut header)? {
+            return self.torn("wal ends with a partial record header");
+        }
+        let crc = u32::from_le_bytes(header[0..4].try_into().unwrap());
+        let len = u32::from_le_bytes(header[4..8].try_into().unwrap());
+        if self.offset + (RECORD_HEADER_SIZE as u64) + len as u64 > self.len {
+            if self.intact_record_follows(&header)? {
+                return Err(self.corruption("wal record length runs past intact records"));
+            }
+            return self.torn("wal ends with a partial record");
+        }
+
+        let mut payload = vec![0u8; len as usize];
+        self.file.read_exact(&mut payload)?;
+        if record_checksum(len, &payload) != crc {
+            if !self.rest_is_zeroed()? {
+                return Err(self.corruption("wal record checksum mismatch"));
+            }
+            return self.torn("wal record checksum mismatch");
+        }
+
+        self.offset += (RECORD_HEADER_SIZE + payload.len()) as u64;
+        Ok(Some(payload))
+    }
+
+    /// Returns the offset of the next record to be read.
+    pub fn offset(&self) -> u64 {
+        self.offset
+    }
+
+    /// Ends the log at a record torn by a crash, or fails with `reason` if the reader is paranoid.
+    fn torn(&self, reason: &str) -> Result<Option<Vec<u8>>> {
+        if self.paranoid {
+            return Err(self.corruption(reason));
+        }
+        Ok(None)
+    }
+
+    fn corruption(&self, reason: &str) -> anyhow::Error {
+        CorruptionError::new(&self.path, self.offset, reason).into()
+    }
+
+    /// Returns whether a complete record with a valid checksum starts anywhere after the start of
+    /// the record at the current offset, whose `header` has just been read. A torn write leaves
+    /// nothing intact after it, so finding one means the record's length was damaged instead.
+    fn intact_record_follows(&mut self, header: &[u8]) -> Result<bool> {
+        let mut data = header[1..].to_vec();
+        self.file.read_to_end(&mut data)?;
+        Ok((0..data.len()).any(|start| {
+            let Some(header) = data.get(start..start + RECORD_HEADER_SIZE) else {
+                return false;
+            };
+            let crc = u32::from_le_bytes(header[0..4].try_into().unwrap());
+            let len = u32::from_le_bytes(header[4..8].try_into().unwrap());
+            let payload = start + RECORD_HEADER_SIZE..start + RECORD_HEADER_SIZE + len as usize;
+            data.get(payload)
+                .is_some_and(|payload| record_checksum(len, payload) == crc)
+        }))
+    }
+
+    /// Returns whether every byte after the record just read is zero, in which case nothing was
+    /// ever written past it.
+    fn rest_is_zeroed(&mut self) -> Result<bool> {
+        let mut buf = [0u8; 4096];
+        loop {
+            match self.file.read(&mut buf)? {
+                0 => return Ok(true),
+                n if buf[..n].iter().any(|&b| b != 0) => return Ok(false),
+                _ => {}
+            }
+        }
+    }
+
+    /// Fills `buf` completely, returning false if the log ends first.
+    fn read_full(&mut self, buf: &mut [u8]) -> Result<bool> {
+        match self.file.read_exact(buf) {
+            Ok(()) => Ok(true),
+            Err(e) if e.kind() == ErrorKind::UnexpectedEof => Ok(false),
+            Err(e) => Err(e.into()),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_util::tmpdir;
+
+    fn write_log(path: &Path, records: &[&[u8]]) {
+        let mut wal = WalWriter::create(path, 0).unwrap();
+        for record in records {
+            wal.append(record).unwrap();
+        }
+        wal.sync().unwrap();
+    }
+
+    /// Pins the record framing so that logs written by earlier releases stay readable.
+    #[test]
+    fn append_matches_golden_bytes() {
+        let dir = tmpdir("wal_golden");
+        let path = dir.join("golden.wal");
+        write_log(&path, &[b"abc", b""]);
+
+        #[rustfmt::skip]
+        let golden: &[u8] = &[
+            0x33, 0x5d, 0xe1, 0x66, 3, 0, 0, 0, b'a', b'b', b'c',  // crc, len, payload
+            0x1c, 0xdf, 0x44, 0x21, 0, 0, 0, 0,                    // crc, len
+        ];
+        assert_eq!(std::fs::read(&path).unwrap(), golden);
+        assert_eq!(read_all(&path, true).unwrap(), [&b"abc"[..], b""]);
+    }
+
+    fn read_all(path: &Path, paranoid: bool) -> Result<Vec<Vec<u8>>> {
+        let mut reader = WalReader::open(path, paranoid)?;
+        let mut records = Vec::new();
+        while let Some(record) = reader.next_record()? {
+            records.push(record);
+        }
+        Ok(records)
+    }
+
+    #[test]
+    fn zero_filled_tail_ends_log() {
+        let path = tmpdir("wal-zero-tail").join("000000.wal");
+        write_log(&path, &[b"one", b"two"]);
+        let mut file = OpenOptions::new().append(true).open(&path).unwrap();
+        file.write_all(&[0; 64]).unwrap();
+
+        assert_eq!(read_all(&path, false).unwrap(), vec![b"one".to_vec(), b"two".to_vec()]);
+        let e = read_all(&path, true).unwrap_err();
+        assert!(e.downcast_ref::<CorruptionError>().is_some());
+    }
+
+    #[test]
+    fn damaged_final_record_ends_log() {
+        let path = tmpdir("wal-bad-tail").join("000000.wal");
+        write_log(&path, &[b"one", b"two"]);
+        let mut data = std::fs::read(&path).unwrap();
+        *data.last_mut().unwrap() ^= 0xff;
+        std::fs::write(&path, data).unwrap();
+
+        assert_eq!(read_all(&path, false).unwrap(), vec![b"one".to_vec()]);
+        assert!(read_all(&path, true).is_err());
+    }
+
+    #[test]
+    fn damaged_middle_record_fails() {
+        let path = tmpdir("wal-bad-middle").join("000000.wal");
+        write_log(&path, &[b"one", b"two"]);
+        let mut data = std::fs::read(&path).unwrap();
+        data[RECORD_HEADER_SIZE] ^= 0xff;
+        std::fs::write(&path, data).unwrap();
+
+        let e = read_all(&path, false).unwrap_err();
+        let e = e.downcast_ref::<CorruptionError>().unwrap();
+        assert_eq!(e.offset, 0);
+    }
+
+    #[test]
+    fn truncation_ends_log_at_last_complete_record() {
+        let dir = tmpdir("wal-truncation");
+        let path = dir.join("000000.wal");
+        let records: [&[u8]; 3] = [b"one", b"", b"three"];
+        write_log(&path, &records);
+        let data = std::fs::read(&path).unwrap();
+        let ends: Vec<usize> = records
+            .iter()
+            .scan(0, |end, record| {
+                *end += RECORD_HEADER_SIZE + record.len();
+                Some(*end)
+            })
+            .collect();
+
+        let truncated = dir.join("truncated.wal");
+        for len in 0..=data.len() {
+            std::fs::write(&truncated, &data[..len]).unwrap();
+            let complete = ends.iter().filter(|end| **end <= len).count();
+            let read = read_all(&truncated, false).unwrap();
+            assert_eq!(read, records[..complete], "truncated to {len} bytes");
+            // A paranoid reader only accepts a log that ends on a record boundary.
+            match read_all(&truncated, true) {
+                Ok(read) => {
+                    assert!(len == 0 || ends.contains(&len), "truncated to {len} bytes");
+                    assert_eq!(read, records[..complete]);
+                }
+                Err(e) => {
+                    assert!(!ends.contains(&len), "truncated to {len} bytes: {e:#}");
+                    assert!(e.is::<CorruptionError>());
+                }
+            }
+        }
+    }
+
+    #[test]
+    fn corruption_is_detected_or_ends_log() {
+        let dir = tmpdir("wal-corruption");
+        let path = dir.join("000000.wal");
+        let records: [&[u8]; 3] = [b"one", b"two", b"three"];
+        write_log(&path, &records);
+        let data = std::fs::read(&path).unwrap();
+        let starts = [0, 11, 22];
+
+        let corrupt = dir.join("corrupt.wal");
+        for i in 0..data.len() {
+            for flip in [0x01, 0x80, 0xff] {
+                let mut damaged = data.clone();
+                damaged[i] ^= flip;
+                std::fs::write(&corrupt, &damaged).unwrap();
+                let record = starts.iter().rposition(|start| *start <= i).unwrap();
+                match read_all(&corrupt, false) {
+                    // Only damage to the final record may be mistaken for a torn write, and then
+                    // only the records before it are returned.
+                    Ok(read) => {
+                        assert_eq!(record, 2, "damage at {i} went undetected");
+                        assert_eq!(read, records[..record]);
+                    }
+                    Err(e) => assert!(e.is::<CorruptionError>(), "damage at {i}: {e:#}"),
+                }
+                let e = read_all(&corrupt, true).expect_err("paranoid read missed damage");
+                assert!(e.is::<CorruptionError>(), "damage at {i}: {e:#}");
+            }
+        }
+    }
+}